@@ -2,15 +2,23 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/config"
 	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
 	"github.com/google/uuid"
+	configclient "github.com/openshift/client-go/config/clientset/versioned"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -20,23 +28,88 @@ import (
 	"k8s.io/klog/v2"
 )
 
-const (
-	leaseLockName = "machineset-egress-cidr-operator.appuio.ch"
-)
-
 func main() {
+	cfg := config.Default()
+	configFile := flag.String("config", "", "Path to an "+config.Kind+" YAML file. Its fields override the command line flags, changes are reloaded at runtime")
+	flag.IntVar(&cfg.Workers, "workers", cfg.Workers, "Number of HostSubnet reconciliation workers")
+	onRelease := flag.String("on-release", string(cfg.OnRelease),
+		"What to do with the egressCIDRs of HostSubnets which are no longer managed: keep, clear or restore. Can be overridden per MachineSet with the "+controller.AnnotationOnRelease+" annotation")
+	dryRun := flag.Bool("dry-run", false, "Log and record the changes to HostSubnets as events instead of applying them")
+	flag.StringVar(&cfg.MachineNamespace, "machine-namespace", cfg.MachineNamespace, "Namespace of Machines and MachineSets")
+	flag.StringVar(&cfg.EgressCIDRsAnnotation, "annotation", cfg.EgressCIDRsAnnotation, "MachineSet annotation holding the egress CIDRs")
+	flag.StringVar(&cfg.EgressIPsAnnotation, "egress-ips-annotation", cfg.EgressIPsAnnotation, "MachineSet annotation holding the egress IPs to spread across its HostSubnets")
+	flag.StringVar(&cfg.MachineSetLabel, "machineset-label", cfg.MachineSetLabel, "Machine label holding the name of the MachineSet")
+	flag.StringVar(&cfg.RoleLabel, "role-label", cfg.RoleLabel, "Machine label holding the role")
+	ignoredRoles := flag.String("ignored-roles", strings.Join(cfg.IgnoredRoles, ","),
+		"Comma separated list of Machine roles which are never managed. Set to an empty string to manage all nodes, including masters")
+	flag.IntVar(&cfg.NodeSubnetPrefix, "node-subnet-prefix", cfg.NodeSubnetPrefix, "Prefix length of the primary node subnet. If set, egress CIDRs outside of a node's subnet are skipped for that node")
+	flag.DurationVar(&cfg.ShutdownTimeout.Duration, "shutdown-timeout", cfg.ShutdownTimeout.Duration, "How long to wait for in-flight HostSubnet updates on shutdown")
+	flag.StringVar(&cfg.MetricsAddr, "metrics-addr", cfg.MetricsAddr, "Address to serve Prometheus metrics on, empty to disable")
+	flag.DurationVar(&cfg.StallTimeout.Duration, "stall-timeout", cfg.StallTimeout.Duration, "How long queued HostSubnets may wait without progress before /livez fails")
+	flag.BoolVar(&cfg.StrictOverlaps, "strict-overlaps", cfg.StrictOverlaps, "Refuse egress CIDR annotations and policies overlapping those of another MachineSet or policy instead of only warning")
+	flag.StringVar(&cfg.HealthAddr, "health-addr", cfg.HealthAddr, "Address to serve /healthz, /readyz and /livez on, empty to disable")
+	networkTypeFlag := flag.String("network-type", string(cfg.NetworkType),
+		"Network plugin to write egress CIDRs for: OpenShiftSDN or OVNKubernetes. Detected from the cluster network config if empty")
+
 	// Parse command line flags and initialize logger
 	klog.InitFlags(flag.CommandLine)
 	flag.Parse()
-	klog.Info("Starting up...")
+
+	cfg.IgnoredRoles = splitList(*ignoredRoles)
+	cfg.OnRelease = controller.ReleasePolicy(*onRelease)
+	cfg.NetworkType = controller.NetworkType(*networkTypeFlag)
+	if *dryRun {
+		cfg.ApplyMode = config.ApplyModeDryRun
+	}
+	if err := cfg.Validate(); err != nil {
+		klog.Exit(err)
+	}
+	flags := cfg
+	if *configFile != "" {
+		var err error
+		if cfg, err = config.Load(*configFile, flags); err != nil {
+			klog.Exit(err)
+		}
+	}
 
 	// load config from ServiceAccount or $KUBECONFIG file
-	config := newConfig()
-	ctrl := controller.New(config)
+	restConfig := newConfig()
+	// cfg keeps the configured value, so reloads don't report a change
+	opts := cfg.Options()
+	networkType, err := controller.DetectNetworkType(context.Background(), configclient.NewForConfigOrDie(restConfig), cfg.NetworkType)
+	if err != nil {
+		klog.Exitf("Network type: %s", err)
+	}
+	opts.NetworkType = networkType
+	if opts.Allocations.Name != "" && opts.Allocations.Namespace == "" {
+		opts.Allocations.Namespace = getNamespace()
+	}
+
+	switch flag.Arg(0) {
+	case "release":
+		requireSDN(flag.Arg(0), networkType)
+		runRelease(flag.Args()[1:])
+		return
+	case "plan":
+		requireSDN(flag.Arg(0), networkType)
+		runPlan(flag.Args()[1:], opts)
+		return
+	}
+	klog.Info("Starting up...")
+	if cfg.ApplyMode == config.ApplyModeDryRun {
+		klog.Info("Dry run, HostSubnets will not be changed")
+	}
+
+	ctrl := controller.New(restConfig, opts)
+	prometheus.MustRegister(ctrl.Collector())
 
-	// ctx will be passed to lock and controller to signal termination
+	// ctx signals termination to the controller, leaderCtx to the lock. The
+	// lease is only released once the controller has stopped.
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	leaderCtx, releaseLease := context.WithCancel(context.Background())
+	defer releaseLease()
+	var leading int32
 
 	// Listen for OS signals
 	done := make(chan os.Signal, 1)
@@ -45,38 +118,77 @@ func main() {
 		<-done
 		klog.Info("Exiting...")
 		cancel()
+		if atomic.LoadInt32(&leading) == 0 {
+			releaseLease()
+		}
 		// defer calls will be fired
 	}()
 
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go serve(ctx, "metrics", cfg.MetricsAddr, mux)
+	}
+	if cfg.HealthAddr != "" {
+		go ctrl.RunHealthChecks(ctx)
+		go serve(ctx, "health checks", cfg.HealthAddr, ctrl.HealthHandler())
+	}
+
+	if *configFile != "" {
+		go config.Watch(ctx, *configFile, flags, 10*time.Second, func(loaded config.Config) {
+			if fields := config.RestartRequired(cfg, loaded); len(fields) > 0 {
+				klog.Warningf("Config<%s>: changes to %s require a restart", *configFile, strings.Join(fields, ", "))
+			}
+			ctrl.Reload(loaded.Options())
+		})
+	}
+
 	// Configure leader lock
 	// leaseIdentity must be unique for each started process
 	leaseIdentity := uuid.New().String()
+	le := cfg.LeaderElection
+	if le.LeaseNamespace == "" {
+		le.LeaseNamespace = getNamespace()
+	}
 	lock := &resourcelock.LeaseLock{
 		LeaseMeta: metav1.ObjectMeta{
-			Name:      leaseLockName,
-			Namespace: getNamespace(),
+			Name:      le.LeaseName,
+			Namespace: le.LeaseNamespace,
 		},
-		Client: clientset.NewForConfigOrDie(config).CoordinationV1(),
+		Client: clientset.NewForConfigOrDie(restConfig).CoordinationV1(),
 		LockConfig: resourcelock.ResourceLockConfig{
 			Identity: leaseIdentity,
 		},
 	}
 
-	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+	leaderelection.RunOrDie(leaderCtx, leaderelection.LeaderElectionConfig{
 		Name: "openshift-meco-leader",
 		Lock: lock,
 		// Important: All code MUST be stopped BEFORE cancel is called!
 		ReleaseOnCancel: true,
 
-		// Use values from core clients
-		LeaseDuration: 15 * time.Second,
-		RenewDeadline: 10 * time.Second,
-		RetryPeriod:   2 * time.Second,
+		LeaseDuration: le.LeaseDuration.Duration,
+		RenewDeadline: le.RenewDeadline.Duration,
+		RetryPeriod:   le.RetryPeriod.Duration,
 
 		Callbacks: leaderelection.LeaderCallbacks{
 			OnStartedLeading: func(c context.Context) {
+				atomic.StoreInt32(&leading, 1)
+				defer releaseLease()
 				klog.Infof("Leader<%s>: got lease", leaseIdentity)
-				ctrl.Run(c)
+
+				// Stop on termination or when losing the lease
+				runCtx, stop := context.WithCancel(c)
+				defer stop()
+				go func() {
+					select {
+					case <-ctx.Done():
+						stop()
+					case <-runCtx.Done():
+					}
+				}()
+				// Blocks until all writes are done
+				ctrl.Run(runCtx)
 			},
 			OnStoppedLeading: func() {
 				klog.Infof("Leader<%s>: lost lease", leaseIdentity)
@@ -93,6 +205,39 @@ func main() {
 
 }
 
+// serve runs an HTTP server until `ctx` is done.
+func serve(ctx context.Context, name, addr string, handler http.Handler) {
+	srv := &http.Server{Addr: addr, Handler: handler}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	klog.Infof("Serving %s on %s", name, addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		klog.Exit(err)
+	}
+}
+
+// requireSDN exits if `networkType` is not supported by `subcommand`.
+func requireSDN(subcommand string, networkType controller.NetworkType) {
+	if networkType != controller.NetworkTypeOpenShiftSDN {
+		klog.Exitf("The %s subcommand only supports %s, the cluster uses %s", subcommand, controller.NetworkTypeOpenShiftSDN, networkType)
+	}
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func newConfig() *rest.Config {
 	if kubeconfig := os.Getenv("KUBECONFIG"); kubeconfig != "" {
 		klog.Infof("KUBECONFIG is set, using %s", kubeconfig)
@@ -0,0 +1,4 @@
+// Package v1alpha1 contains the EgressCIDRPolicy API.
+// +kubebuilder:object:generate=true
+// +groupName=egress.appuio.ch
+package v1alpha1
@@ -0,0 +1,92 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ApplyMode controls whether a policy is written to HostSubnets.
+// +kubebuilder:validation:Enum=Enforce;Observe
+type ApplyMode string
+
+const (
+	// ApplyModeEnforce writes the policy's CIDRs to all matched HostSubnets.
+	ApplyModeEnforce ApplyMode = "Enforce"
+	// ApplyModeObserve only reports in the status whether the matched
+	// HostSubnets are in sync, without writing anything.
+	ApplyModeObserve ApplyMode = "Observe"
+)
+
+// SyncState summarizes the state of a policy.
+type SyncState string
+
+const (
+	// SyncStateSynced means all matched HostSubnets have the policy's CIDRs.
+	SyncStateSynced SyncState = "Synced"
+	// SyncStateOutOfSync means some matched HostSubnets differ from the
+	// policy's CIDRs.
+	SyncStateOutOfSync SyncState = "OutOfSync"
+	// SyncStateConflict means some targets are claimed by a MachineSet
+	// annotation or an older policy and are not managed by this policy, or
+	// the policy's CIDRs were not applied to some targets.
+	SyncStateConflict SyncState = "Conflict"
+	// SyncStateInvalid means the policy's spec is invalid.
+	SyncStateInvalid SyncState = "Invalid"
+)
+
+// EgressCIDRPolicySpec selects the nodes that get the listed egress CIDRs.
+// Exactly one of MachineSetSelector and NodeSelector must be set.
+type EgressCIDRPolicySpec struct {
+	// MachineSetSelector selects MachineSets by label. All nodes belonging to
+	// a matching MachineSet get the CIDRs.
+	// +optional
+	MachineSetSelector *metav1.LabelSelector `json:"machineSetSelector,omitempty"`
+
+	// NodeSelector selects nodes by label.
+	// +optional
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+
+	// CIDRs to set as egressCIDRs. An empty list removes all egressCIDRs.
+	CIDRs []string `json:"cidrs"`
+
+	// ApplyMode defaults to Enforce.
+	// +optional
+	ApplyMode ApplyMode `json:"applyMode,omitempty"`
+}
+
+// EgressCIDRPolicyStatus is the observed state of an EgressCIDRPolicy.
+type EgressCIDRPolicyStatus struct {
+	// ObservedGeneration is the generation this status refers to.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// MatchedNodes lists the nodes managed by this policy.
+	MatchedNodes []string `json:"matchedNodes,omitempty"`
+	// SyncState summarizes whether the matched nodes are in sync.
+	SyncState SyncState `json:"syncState,omitempty"`
+	// Message explains the SyncState.
+	Message string `json:"message,omitempty"`
+}
+
+// +genclient
+// +genclient:nonNamespaced
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
+
+// EgressCIDRPolicy assigns egress CIDRs to the HostSubnets of selected
+// MachineSets or nodes.
+type EgressCIDRPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EgressCIDRPolicySpec   `json:"spec"`
+	Status EgressCIDRPolicyStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// EgressCIDRPolicyList is a list of EgressCIDRPolicy objects.
+type EgressCIDRPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []EgressCIDRPolicy `json:"items"`
+}
@@ -0,0 +1,314 @@
+// Package config loads the versioned configuration file of the operator.
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	APIVersion = "egress.appuio.ch/v1alpha1"
+	Kind       = "OperatorConfig"
+)
+
+// ApplyMode selects whether changes are applied.
+type ApplyMode string
+
+const (
+	// ApplyModeEnforce applies all changes to HostSubnets.
+	ApplyModeEnforce ApplyMode = "Enforce"
+	// ApplyModeDryRun only logs and records changes, see
+	// controller.Options.DryRun.
+	ApplyModeDryRun ApplyMode = "DryRun"
+)
+
+// Config is the content of the configuration file. Fields missing in the file
+// keep the value given on the command line.
+type Config struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// Workers is the number of HostSubnet reconciliation workers.
+	Workers int `json:"workers"`
+	// ResyncPeriod of all informers.
+	ResyncPeriod metav1.Duration `json:"resyncPeriod"`
+	// ShutdownTimeout bounds how long in-flight updates may take on shutdown.
+	ShutdownTimeout metav1.Duration `json:"shutdownTimeout"`
+	// MetricsAddr to serve metrics on, empty to disable.
+	MetricsAddr string `json:"metricsAddr"`
+	// HealthAddr to serve health checks on, empty to disable.
+	HealthAddr string `json:"healthAddr"`
+	// StallTimeout is how long queued items may wait without progress before
+	// the liveness check fails.
+	StallTimeout metav1.Duration `json:"stallTimeout"`
+
+	MachineNamespace      string   `json:"machineNamespace"`
+	EgressCIDRsAnnotation string   `json:"egressCIDRsAnnotation"`
+	EgressIPsAnnotation   string   `json:"egressIPsAnnotation"`
+	MachineSetLabel       string   `json:"machineSetLabel"`
+	RoleLabel             string   `json:"roleLabel"`
+	IgnoredRoles          []string `json:"ignoredRoles"`
+	// NodeSubnetPrefix is the prefix length of the primary node subnet, 0
+	// to apply egress CIDRs without checking that they are reachable.
+	NodeSubnetPrefix int `json:"nodeSubnetPrefix"`
+
+	// NetworkType is detected if empty.
+	NetworkType controller.NetworkType `json:"networkType"`
+
+	OnRelease controller.ReleasePolicy `json:"onRelease"`
+	ApplyMode ApplyMode                `json:"applyMode"`
+	// StrictOverlaps refuses annotations and policy CIDRs overlapping the
+	// CIDRs of another MachineSet or policy instead of only warning about them.
+	StrictOverlaps bool `json:"strictOverlaps"`
+
+	LeaderElection     LeaderElection     `json:"leaderElection"`
+	EgressIPAllocation EgressIPAllocation `json:"egressIPAllocation"`
+	Features           Features           `json:"features"`
+}
+
+// LeaderElection configures the leader lease.
+type LeaderElection struct {
+	LeaseName string `json:"leaseName"`
+	// LeaseNamespace defaults to the namespace of the operator.
+	LeaseNamespace string          `json:"leaseNamespace"`
+	LeaseDuration  metav1.Duration `json:"leaseDuration"`
+	RenewDeadline  metav1.Duration `json:"renewDeadline"`
+	RetryPeriod    metav1.Duration `json:"retryPeriod"`
+}
+
+// EgressIPAllocation configures where the egress IPs allocated to
+// NetNamespaces are persisted.
+type EgressIPAllocation struct {
+	ConfigMapName string `json:"configMapName"`
+	// ConfigMapNamespace defaults to the namespace of the operator.
+	ConfigMapNamespace string `json:"configMapNamespace"`
+}
+
+// Features toggles optional functionality.
+type Features struct {
+	// EgressCIDRPolicies enables the EgressCIDRPolicy API, if installed.
+	EgressCIDRPolicies bool `json:"egressCIDRPolicies"`
+	// EgressIPAllocation allocates egress IPs to NetNamespaces on request.
+	EgressIPAllocation bool `json:"egressIPAllocation"`
+}
+
+// Default returns the built-in configuration.
+func Default() Config {
+	layout := controller.DefaultLayout()
+	return Config{
+		APIVersion:            APIVersion,
+		Kind:                  Kind,
+		Workers:               2,
+		ResyncPeriod:          metav1.Duration{Duration: time.Hour},
+		ShutdownTimeout:       metav1.Duration{Duration: 10 * time.Second},
+		MetricsAddr:           ":8080",
+		HealthAddr:            ":8081",
+		StallTimeout:          metav1.Duration{Duration: 5 * time.Minute},
+		MachineNamespace:      layout.MachineNamespace,
+		EgressCIDRsAnnotation: layout.EgressCIDRsAnnotation,
+		EgressIPsAnnotation:   layout.EgressIPsAnnotation,
+		MachineSetLabel:       layout.MachineSetLabel,
+		RoleLabel:             layout.RoleLabel,
+		IgnoredRoles:          layout.IgnoredRoles,
+		OnRelease:             controller.ReleaseKeep,
+		ApplyMode:             ApplyModeEnforce,
+		LeaderElection: LeaderElection{
+			LeaseName:     controller.LeaseLockName,
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+			RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+		},
+		EgressIPAllocation: EgressIPAllocation{
+			ConfigMapName: "machineset-egress-cidr-operator-allocations",
+		},
+		Features: Features{
+			EgressCIDRPolicies: true,
+		},
+	}
+}
+
+// Parse reads a configuration file on top of `base`.
+func Parse(data []byte, base Config) (Config, error) {
+	c := base
+	// Unmarshal reuses the backing array of slices
+	c.IgnoredRoles = append([]string(nil), base.IgnoredRoles...)
+	c.APIVersion, c.Kind = "", ""
+
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return base, err
+	}
+	if c.APIVersion != APIVersion || c.Kind != Kind {
+		return base, fmt.Errorf("unsupported config %s %s, expected %s %s", c.APIVersion, c.Kind, APIVersion, Kind)
+	}
+	if err := c.Validate(); err != nil {
+		return base, err
+	}
+	return c, nil
+}
+
+// Load reads the configuration file at `path` on top of `base`.
+func Load(path string, base Config) (Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return base, err
+	}
+	c, err := Parse(data, base)
+	if err != nil {
+		return base, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Validate checks all fields.
+func (c Config) Validate() error {
+	var errs []string
+	if c.Workers < 1 {
+		errs = append(errs, "workers must be at least 1")
+	}
+	if c.ResyncPeriod.Duration <= 0 {
+		errs = append(errs, "resyncPeriod must be positive")
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		errs = append(errs, "shutdownTimeout must be positive")
+	}
+	if c.StallTimeout.Duration <= 0 {
+		errs = append(errs, "stallTimeout must be positive")
+	}
+	if err := c.Layout().Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if _, err := controller.ParseReleasePolicy(string(c.OnRelease)); err != nil {
+		errs = append(errs, "onRelease: "+err.Error())
+	}
+	switch c.NetworkType {
+	case "", controller.NetworkTypeOpenShiftSDN, controller.NetworkTypeOVNKubernetes:
+	default:
+		errs = append(errs, fmt.Sprintf("networkType must be empty, %s or %s", controller.NetworkTypeOpenShiftSDN, controller.NetworkTypeOVNKubernetes))
+	}
+	if c.ApplyMode != ApplyModeEnforce && c.ApplyMode != ApplyModeDryRun {
+		errs = append(errs, fmt.Sprintf("applyMode must be %s or %s", ApplyModeEnforce, ApplyModeDryRun))
+	}
+	le := c.LeaderElection
+	if le.LeaseName == "" {
+		errs = append(errs, "leaderElection.leaseName must be set")
+	}
+	if le.LeaseDuration.Duration <= le.RenewDeadline.Duration || le.RenewDeadline.Duration <= le.RetryPeriod.Duration || le.RetryPeriod.Duration <= 0 {
+		errs = append(errs, "leaderElection durations must satisfy leaseDuration > renewDeadline > retryPeriod > 0")
+	}
+	if c.Features.EgressIPAllocation && c.EgressIPAllocation.ConfigMapName == "" {
+		errs = append(errs, "egressIPAllocation.configMapName must be set")
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Layout returns the controller.Layout configured by `c`.
+func (c Config) Layout() controller.Layout {
+	return controller.Layout{
+		MachineNamespace:      c.MachineNamespace,
+		EgressCIDRsAnnotation: c.EgressCIDRsAnnotation,
+		EgressIPsAnnotation:   c.EgressIPsAnnotation,
+		MachineSetLabel:       c.MachineSetLabel,
+		RoleLabel:             c.RoleLabel,
+		IgnoredRoles:          c.IgnoredRoles,
+		NodeSubnetPrefix:      c.NodeSubnetPrefix,
+	}
+}
+
+// Options returns the controller.Options configured by `c`. The namespace of
+// the allocations ConfigMap is left empty if it defaults to the namespace of
+// the operator.
+func (c Config) Options() controller.Options {
+	var allocations types.NamespacedName
+	if c.Features.EgressIPAllocation {
+		allocations = types.NamespacedName{
+			Name:      c.EgressIPAllocation.ConfigMapName,
+			Namespace: c.EgressIPAllocation.ConfigMapNamespace,
+		}
+	}
+	return controller.Options{
+		Layout:               c.Layout(),
+		Workers:              c.Workers,
+		DefaultReleasePolicy: c.OnRelease,
+		DryRun:               c.ApplyMode == ApplyModeDryRun,
+		ResyncPeriod:         c.ResyncPeriod.Duration,
+		NetworkType:          c.NetworkType,
+		DisablePolicies:      !c.Features.EgressCIDRPolicies,
+		ShutdownTimeout:      c.ShutdownTimeout.Duration,
+		StallTimeout:         c.StallTimeout.Duration,
+		StrictOverlaps:       c.StrictOverlaps,
+		Allocations:          allocations,
+	}
+}
+
+// RestartRequired returns the fields which differ between `running` and
+// `loaded` and can't be changed without a restart.
+func RestartRequired(running, loaded Config) []string {
+	fields := make([]string, 0)
+	for name, values := range map[string][2]interface{}{
+		"workers":            {running.Workers, loaded.Workers},
+		"resyncPeriod":       {running.ResyncPeriod, loaded.ResyncPeriod},
+		"shutdownTimeout":    {running.ShutdownTimeout, loaded.ShutdownTimeout},
+		"metricsAddr":        {running.MetricsAddr, loaded.MetricsAddr},
+		"healthAddr":         {running.HealthAddr, loaded.HealthAddr},
+		"stallTimeout":       {running.StallTimeout, loaded.StallTimeout},
+		"machineNamespace":   {running.MachineNamespace, loaded.MachineNamespace},
+		"networkType":        {running.NetworkType, loaded.NetworkType},
+		"leaderElection":     {running.LeaderElection, loaded.LeaderElection},
+		"egressIPAllocation": {running.EgressIPAllocation, loaded.EgressIPAllocation},
+		"features":           {running.Features, loaded.Features},
+	} {
+		if !reflect.DeepEqual(values[0], values[1]) {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// Watch polls the configuration file at `path` every `interval` until `ctx`
+// is done and calls `reload` with the new configuration whenever the file
+// content changes. Invalid files are logged and otherwise ignored.
+func Watch(ctx context.Context, path string, base Config, interval time.Duration, reload func(Config)) {
+	last, err := ioutil.ReadFile(path)
+	if err != nil {
+		klog.Errorf("Config<%s>: %s", path, err)
+	}
+
+	wait.Until(func() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			klog.Errorf("Config<%s>: %s", path, err)
+			return
+		}
+		if bytes.Equal(data, last) {
+			return
+		}
+		last = data
+
+		c, err := Parse(data, base)
+		if err != nil {
+			klog.Errorf("Config<%s>: ignoring invalid config: %s", path, err)
+			return
+		}
+		klog.Infof("Config<%s>: reloading", path)
+		reload(c)
+	}, interval, ctx.Done())
+}
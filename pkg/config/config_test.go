@@ -0,0 +1,83 @@
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/config"
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	"github.com/matryer/is"
+)
+
+func TestParse(t *testing.T) {
+	is := is.New(t)
+	base := config.Default()
+
+	c, err := config.Parse([]byte(`
+apiVersion: egress.appuio.ch/v1alpha1
+kind: OperatorConfig
+workers: 4
+resyncPeriod: 30m
+ignoredRoles: []
+onRelease: restore
+applyMode: DryRun
+`), base)
+	is.NoErr(err)
+	is.Equal(c.Workers, 4)
+	is.Equal(c.ResyncPeriod.Duration, 30*time.Minute)
+	is.Equal(c.IgnoredRoles, []string{})
+	is.Equal(c.OnRelease, controller.ReleaseRestore)
+	is.Equal(c.MachineNamespace, base.MachineNamespace) // not in file, kept
+	is.Equal(base.IgnoredRoles, []string{"master"})     // base not modified
+
+	opts := c.Options()
+	is.True(opts.DryRun)
+	is.Equal(len(opts.Layout.IgnoredRoles), 0)
+}
+
+func TestParseInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"no version":    "workers: 4",
+		"wrong kind":    "apiVersion: egress.appuio.ch/v1alpha1\nkind: Other",
+		"unknown field": "apiVersion: egress.appuio.ch/v1alpha1\nkind: OperatorConfig\nworker: 4",
+		"invalid value": "apiVersion: egress.appuio.ch/v1alpha1\nkind: OperatorConfig\nonRelease: forget",
+		"lease durations": "apiVersion: egress.appuio.ch/v1alpha1\nkind: OperatorConfig\n" +
+			"leaderElection: {leaseName: x, leaseDuration: 1s, renewDeadline: 2s, retryPeriod: 1s}",
+	} {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			_, err := config.Parse([]byte(data), config.Default())
+			is.True(err != nil)
+		})
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	is := is.New(t)
+	running := config.Default()
+	loaded := config.Default()
+	loaded.OnRelease = controller.ReleaseClear
+	loaded.IgnoredRoles = nil
+	is.Equal(config.RestartRequired(running, loaded), []string{})
+
+	loaded.Workers = 5
+	loaded.LeaderElection.LeaseName = "other"
+	loaded.NetworkType = controller.NetworkTypeOVNKubernetes
+	loaded.EgressIPAllocation.ConfigMapNamespace = "other"
+	is.Equal(config.RestartRequired(running, loaded), []string{"egressIPAllocation", "leaderElection", "networkType", "workers"})
+}
+
+func TestOptionsAllocations(t *testing.T) {
+	is := is.New(t)
+	c := config.Default()
+	is.Equal(c.Options().Allocations.Name, "") // disabled by default
+
+	c.Features.EgressIPAllocation = true
+	c.EgressIPAllocation.ConfigMapNamespace = "egress"
+	opts := c.Options()
+	is.Equal(opts.Allocations.Name, "machineset-egress-cidr-operator-allocations")
+	is.Equal(opts.Allocations.Namespace, "egress")
+
+	c.EgressIPAllocation.ConfigMapName = ""
+	is.True(c.Validate() != nil)
+}
@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+
+	v1 "github.com/openshift/api/network/v1"
+)
+
+const (
+	// AnnotationEgressIPRequest on a Namespace requests an egress IP from the
+	// CIDRs of the MachineSet named by the value.
+	AnnotationEgressIPRequest = "appuio.ch/egress-ip-machineset"
+	// AnnotationEgressIPAllocated on a Namespace shows the allocated egress
+	// IP. It's informational only, allocations are tracked in a ConfigMap.
+	AnnotationEgressIPAllocated = "appuio.ch/egress-ip"
+	// AnnotationReservedIPs on a MachineSet lists IPs within its CIDRs which
+	// are never allocated, e.g. gateways.
+	AnnotationReservedIPs = "appuio.ch/egress-ips-reserved"
+)
+
+// Allocation is an egress IP allocated to a namespace.
+type Allocation struct {
+	MachineSet string                  `json:"machineSet"`
+	IP         v1.NetNamespaceEgressIP `json:"ip"`
+}
+
+// Allocations maps namespace names to their Allocation.
+type Allocations map[string]Allocation
+
+// Encode renders `a` as ConfigMap data, one key per namespace.
+func (a Allocations) Encode() (map[string]string, error) {
+	data := make(map[string]string, len(a))
+	for ns, alloc := range a {
+		v, err := json.Marshal(alloc)
+		if err != nil {
+			return nil, err
+		}
+		data[ns] = string(v)
+	}
+	return data, nil
+}
+
+// DecodeAllocations reads ConfigMap data written by Encode. Invalid entries
+// are skipped and returned as errors.
+func DecodeAllocations(data map[string]string) (Allocations, []error) {
+	a := make(Allocations, len(data))
+	var errs []error
+	for ns, v := range data {
+		var alloc Allocation
+		if err := json.Unmarshal([]byte(v), &alloc); err != nil {
+			errs = append(errs, fmt.Errorf("namespace %s: %w", ns, err))
+			continue
+		}
+		if alloc.MachineSet == "" || net.ParseIP(string(alloc.IP)).To4() == nil {
+			errs = append(errs, fmt.Errorf("namespace %s: invalid allocation %s", ns, v))
+			continue
+		}
+		a[ns] = alloc
+	}
+	return a, errs
+}
+
+// NextFreeIP returns the lowest address within `cidrs` which is not `used`.
+// The network and broadcast addresses of each CIDR are never returned.
+func NextFreeIP(cidrs []v1.HostSubnetEgressCIDR, used map[string]bool) (v1.NetNamespaceEgressIP, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(string(cidr))
+		if err != nil || ipnet.IP.To4() == nil {
+			continue
+		}
+		networks = append(networks, ipnet)
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		return ipToUint(networks[i].IP) < ipToUint(networks[j].IP)
+	})
+
+	for _, ipnet := range networks {
+		ones, bits := ipnet.Mask.Size()
+		first := ipToUint(ipnet.IP)
+		last := first + uint32(1)<<uint(bits-ones) - 1
+		if bits-ones > 1 {
+			// Skip network and broadcast address, /31 and /32 have none
+			first, last = first+1, last-1
+		}
+		for i := first; i <= last && i >= first; i++ {
+			ip := uintToIP(i).String()
+			if !used[ip] {
+				return v1.NetNamespaceEgressIP(ip), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no free IP in %v", cidrs)
+}
+
+// AllocationOutdated returns true if `alloc` must be replaced for a namespace
+// requesting an egress IP from `machineSet`: it was allocated from another
+// MachineSet, or the IP is no longer within the CIDRs of `machineSet`. While
+// `cidrs` has no entry for `machineSet`, e.g. because it's not populated yet,
+// the allocation is kept.
+func AllocationOutdated(alloc Allocation, machineSet string, cidrs *CIDRMap) bool {
+	if alloc.MachineSet != machineSet {
+		return true
+	}
+	return cidrs.Exists(machineSet) && !containsEgressIP(cidrs.Get(machineSet), alloc.IP)
+}
+
+// containsEgressIP returns true if `ip` is within any of `cidrs`.
+func containsEgressIP(cidrs []v1.HostSubnetEgressCIDR, ip v1.NetNamespaceEgressIP) bool {
+	parsed := net.ParseIP(string(ip))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(string(cidr))
+		if err == nil && ipnet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uintToIP(i uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
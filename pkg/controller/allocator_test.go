@@ -0,0 +1,87 @@
+package controller_test
+
+import (
+	"testing"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	"github.com/matryer/is"
+	v1 "github.com/openshift/api/network/v1"
+)
+
+func TestNextFreeIP(t *testing.T) {
+	for _, c := range []struct {
+		Name     string
+		CIDRs    []v1.HostSubnetEgressCIDR
+		Used     []string
+		Expected v1.NetNamespaceEgressIP
+	}{
+		{"skips network address", []v1.HostSubnetEgressCIDR{"192.0.2.0/29"}, nil, "192.0.2.1"},
+		{"skips used", []v1.HostSubnetEgressCIDR{"192.0.2.0/29"}, []string{"192.0.2.1", "192.0.2.2"}, "192.0.2.3"},
+		{"skips broadcast address", []v1.HostSubnetEgressCIDR{"192.0.2.0/30", "192.0.2.8/30"},
+			[]string{"192.0.2.1", "192.0.2.2"}, "192.0.2.9"},
+		{"lowest CIDR first", []v1.HostSubnetEgressCIDR{"198.51.100.0/24", "192.0.2.0/24"}, nil, "192.0.2.1"},
+		{"host route", []v1.HostSubnetEgressCIDR{"192.0.2.7/32"}, nil, "192.0.2.7"},
+		{"point to point", []v1.HostSubnetEgressCIDR{"192.0.2.6/31"}, []string{"192.0.2.6"}, "192.0.2.7"},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			is := is.New(t)
+			used := make(map[string]bool)
+			for _, ip := range c.Used {
+				used[ip] = true
+			}
+			ip, err := controller.NextFreeIP(c.CIDRs, used)
+			is.NoErr(err)
+			is.Equal(ip, c.Expected)
+		})
+	}
+
+	t.Run("exhausted", func(t *testing.T) {
+		is := is.New(t)
+		_, err := controller.NextFreeIP([]v1.HostSubnetEgressCIDR{"192.0.2.0/30"},
+			map[string]bool{"192.0.2.1": true, "192.0.2.2": true})
+		is.True(err != nil)
+	})
+}
+
+func TestAllocationsEncoding(t *testing.T) {
+	is := is.New(t)
+	allocations := controller.Allocations{
+		"tenant-a": {MachineSet: "infra-a", IP: "192.0.2.1"},
+		"tenant-b": {MachineSet: "infra-b", IP: "198.51.100.1"},
+	}
+	data, err := allocations.Encode()
+	is.NoErr(err)
+	is.Equal(data["tenant-a"], `{"machineSet":"infra-a","ip":"192.0.2.1"}`)
+
+	data["broken"] = "{"
+	data["no-machineset"] = `{"ip":"192.0.2.2"}`
+	data["invalid-ip"] = `{"machineSet":"infra-a","ip":"fd00::1"}`
+	decoded, errs := controller.DecodeAllocations(data)
+	is.Equal(len(errs), 3)
+	is.Equal(decoded, allocations)
+}
+
+func TestAllocationOutdated(t *testing.T) {
+	alloc := controller.Allocation{MachineSet: "infra-a", IP: "192.0.2.5"}
+	for _, c := range []struct {
+		Name       string
+		MachineSet string
+		CIDRs      map[string]string
+		Expected   bool
+	}{
+		{"within cidrs", "infra-a", map[string]string{"infra-a": "192.0.2.0/24"}, false},
+		{"entry not populated yet", "infra-a", map[string]string{}, false},
+		{"cidrs shrunk", "infra-a", map[string]string{"infra-a": "192.0.2.128/25"}, true},
+		{"cidrs removed", "infra-a", map[string]string{"infra-a": "none"}, true},
+		{"other machineset", "infra-b", map[string]string{"infra-a": "192.0.2.0/24", "infra-b": "192.0.2.0/24"}, true},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			is := is.New(t)
+			cm := controller.NewCIDRMap()
+			for ms, cidrs := range c.CIDRs {
+				is.NoErr(cm.Set(ms, cidrs))
+			}
+			is.Equal(controller.AllocationOutdated(alloc, c.MachineSet, cm), c.Expected)
+		})
+	}
+}
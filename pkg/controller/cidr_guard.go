@@ -0,0 +1,198 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/apis/egress/v1alpha1"
+	v1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// AnnotationForceCIDRs set to "true" on a MachineSet applies changes to its
+// egress CIDRs even if NetNamespaces lose their egress IPs. On an
+// EgressCIDRPolicy it does the same for all its targets, on a Node for the
+// CIDRs it gets from a policy node selector.
+const AnnotationForceCIDRs = "appuio.ch/egress-cidrs-force"
+
+// StrandedEgressIPs returns the egress IPs of `netNamespaces`, by namespace,
+// which are within `current` but not within `proposed`.
+func StrandedEgressIPs(current, proposed []v1.HostSubnetEgressCIDR, netNamespaces []*v1.NetNamespace) map[string][]v1.NetNamespaceEgressIP {
+	stranded := make(map[string][]v1.NetNamespaceEgressIP)
+	for _, netns := range netNamespaces {
+		for _, ip := range netns.EgressIPs {
+			if containsEgressIP(current, ip) && !containsEgressIP(proposed, ip) {
+				stranded[netns.Name] = append(stranded[netns.Name], ip)
+			}
+		}
+	}
+	return stranded
+}
+
+// guardCIDRs returns true if the egress CIDRs of `ms` may be replaced by
+// `proposed`. Changes which would strand egress IPs of NetNamespaces, or of
+// namespaces allocated from `ms`, are refused with an event listing the
+// namespaces, unless `ms` has AnnotationForceCIDRs.
+func (c *Controller) guardCIDRs(ms *v1beta1.MachineSet, proposed []v1.HostSubnetEgressCIDR) bool {
+	msg := c.strandedBy(ms.Name, proposed)
+	if msg == "" {
+		return true
+	}
+
+	if forcesCIDRs(ms) {
+		klog.Warningf("MachineSet<%s>: forced change of egress CIDRs to %v, NetNamespaces lose egress IPs: %s", ms.Name, proposed, msg)
+		c.recorder.Eventf(ms, corev1.EventTypeWarning, ReasonCIDRsInUse,
+			"Forced change of egress CIDRs to %v, NetNamespaces lose egress IPs: %s", proposed, msg)
+		return true
+	}
+	klog.Errorf("MachineSet<%s>: refusing egress CIDRs %v, keeping %v: NetNamespaces would lose egress IPs: %s",
+		ms.Name, proposed, c.cidrs.Get(ms.Name), msg)
+	c.recorder.Eventf(ms, corev1.EventTypeWarning, ReasonCIDRsInUse,
+		"Refusing egress CIDRs %v, keeping %v: NetNamespaces would lose egress IPs: %s. Set annotation %s=true to apply anyway",
+		proposed, c.cidrs.Get(ms.Name), msg, AnnotationForceCIDRs)
+	return false
+}
+
+// strandedBy returns the egress IPs of NetNamespaces, and of namespaces
+// allocated from `key`, which replacing the CIDRMap entry `key` by `proposed`
+// would strand, rendered by joinStranded. Empty if there are none.
+func (c *Controller) strandedBy(key string, proposed []v1.HostSubnetEgressCIDR) string {
+	if c.netNamespaces == nil {
+		return ""
+	}
+	netNamespaces, err := c.netNamespaces.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("list netnamespaces: %s", err)
+		return ""
+	}
+	stranded := StrandedEgressIPs(c.cidrs.Get(key), proposed, netNamespaces)
+	c.allocationMutex.Lock()
+	for ns, alloc := range c.allocations {
+		if alloc.MachineSet == key && !containsEgressIP(proposed, alloc.IP) &&
+			!containsNetNamespaceIP(stranded[ns], alloc.IP) {
+			stranded[ns] = append(stranded[ns], alloc.IP)
+		}
+	}
+	c.allocationMutex.Unlock()
+	if len(stranded) == 0 {
+		return ""
+	}
+	return joinStranded(stranded)
+}
+
+// forcesCIDRs returns true if `obj` has AnnotationForceCIDRs.
+func forcesCIDRs(obj metav1.Object) bool {
+	return obj.GetAnnotations()[AnnotationForceCIDRs] == "true"
+}
+
+// GuardCIDRMap applies the check of guardCIDRs to the `cidrs` built by
+// BuildCIDRMap. The current egress CIDRs of each CIDRMap key are those of the
+// `hostSubnets` it manages. Entries which would strand egress IPs of
+// `netNamespaces` are reset to the current egress CIDRs, unless the
+// MachineSet, Node or EgressCIDRPolicy behind the key has
+// AnnotationForceCIDRs. Both refused and forced changes are returned as
+// errors.
+func GuardCIDRMap(
+	opts Options,
+	cidrs *CIDRMap,
+	hostSubnets []*v1.HostSubnet,
+	netNamespaces []*v1.NetNamespace,
+	machineSets []*v1beta1.MachineSet,
+	policies []*v1alpha1.EgressCIDRPolicy,
+	nodes []*corev1.Node,
+) []error {
+	current := make(map[string][]v1.HostSubnetEgressCIDR)
+	for _, hs := range hostSubnets {
+		if key := hs.Annotations[AnnotationManagedBy]; key != "" {
+			current[key] = append(current[key], hs.EgressCIDRs...)
+		}
+	}
+
+	forced := make(map[string]bool)
+	for _, ms := range machineSets {
+		forced[ms.Name] = forcesCIDRs(ms)
+	}
+	for _, node := range nodes {
+		forced[NodeKey(node.Name)] = forcesCIDRs(node)
+	}
+	_, results := ResolvePolicies(opts.Layout, cidrs.Reserved(), policies, machineSets, nodes)
+	for _, p := range policies {
+		if forcesCIDRs(p) {
+			for _, key := range results[p.Name].Keys {
+				forced[key] = true
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(current))
+	for key := range current {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		proposed := cidrs.Get(key)
+		stranded := StrandedEgressIPs(current[key], proposed, netNamespaces)
+		if len(stranded) == 0 {
+			continue
+		}
+		msg := joinStranded(stranded)
+		kind, name := keyTarget(key)
+		if forced[key] {
+			errs = append(errs, fmt.Errorf("%s %s: forced change of egress CIDRs to %v, NetNamespaces lose egress IPs: %s",
+				kind, name, proposed, msg))
+			continue
+		}
+		errs = append(errs, fmt.Errorf("%s %s: refusing egress CIDRs %v, keeping %v: NetNamespaces would lose egress IPs: %s",
+			kind, name, proposed, current[key], msg))
+		if !cidrs.Exists(key) {
+			cidrs.SetReleasePolicy(key, opts.DefaultReleasePolicy)
+		}
+		// Taken from HostSubnets, reserved networks are not checked again
+		_ = cidrs.Set(key, joinCIDRs(current[key]))
+	}
+	return errs
+}
+
+// keyTarget returns the kind and name of the target of the CIDRMap entry
+// `key`.
+func keyTarget(key string) (kind, name string) {
+	if strings.HasPrefix(key, nodeKeyPrefix) {
+		return "Node", strings.TrimPrefix(key, nodeKeyPrefix)
+	}
+	return "MachineSet", key
+}
+
+// joinCIDRs renders `cidrs` in the format accepted by CIDRMap.Set.
+func joinCIDRs(cidrs []v1.HostSubnetEgressCIDR) string {
+	s := make([]string, len(cidrs))
+	for i, cidr := range cidrs {
+		s[i] = string(cidr)
+	}
+	return strings.Join(s, ",")
+}
+
+// joinStranded renders the result of StrandedEgressIPs sorted by namespace.
+func joinStranded(stranded map[string][]v1.NetNamespaceEgressIP) string {
+	msgs := make([]string, 0, len(stranded))
+	for ns, ips := range stranded {
+		msgs = append(msgs, fmt.Sprintf("%s %v", ns, ips))
+	}
+	sort.Strings(msgs)
+	return strings.Join(msgs, ", ")
+}
+
+func containsNetNamespaceIP(ips []v1.NetNamespaceEgressIP, ip v1.NetNamespaceEgressIP) bool {
+	for _, other := range ips {
+		if other == ip {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package controller_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/apis/egress/v1alpha1"
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	"github.com/matryer/is"
+	v1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestStrandedEgressIPs(t *testing.T) {
+	netNamespaces := []*v1.NetNamespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "kept"}, EgressIPs: []v1.NetNamespaceEgressIP{"192.0.2.5"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "stranded"}, EgressIPs: []v1.NetNamespaceEgressIP{"192.0.2.5", "192.0.2.130"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "elsewhere"}, EgressIPs: []v1.NetNamespaceEgressIP{"198.51.100.1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "none"}},
+	}
+	current := []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}
+
+	for _, c := range []struct {
+		Name     string
+		Proposed []v1.HostSubnetEgressCIDR
+		Expected map[string][]v1.NetNamespaceEgressIP
+	}{
+		{"unchanged", current, map[string][]v1.NetNamespaceEgressIP{}},
+		{"grown", []v1.HostSubnetEgressCIDR{"192.0.0.0/16"}, map[string][]v1.NetNamespaceEgressIP{}},
+		{"shrunk", []v1.HostSubnetEgressCIDR{"192.0.2.0/25"},
+			map[string][]v1.NetNamespaceEgressIP{"stranded": {"192.0.2.130"}}},
+		{"removed", nil, map[string][]v1.NetNamespaceEgressIP{
+			"kept":     {"192.0.2.5"},
+			"stranded": {"192.0.2.5", "192.0.2.130"},
+		}},
+		{"none", []v1.HostSubnetEgressCIDR{"none"}, map[string][]v1.NetNamespaceEgressIP{
+			"kept":     {"192.0.2.5"},
+			"stranded": {"192.0.2.5", "192.0.2.130"},
+		}},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(controller.StrandedEgressIPs(current, c.Proposed, netNamespaces), c.Expected)
+		})
+	}
+}
+
+func TestGuardCIDRsSyncMachineSet(t *testing.T) {
+	netns := &v1.NetNamespace{ObjectMeta: metav1.ObjectMeta{Name: "app"}, EgressIPs: []v1.NetNamespaceEgressIP{"192.0.2.130"}}
+
+	for _, c := range []struct {
+		Name     string
+		CIDRs    string
+		Force    bool
+		Expected []v1.HostSubnetEgressCIDR
+		Event    string
+	}{
+		{"shrunk", "192.0.2.0/25", false, []v1.HostSubnetEgressCIDR{"192.0.2.0/24"},
+			"Warning EgressCIDRsInUse Refusing egress CIDRs [192.0.2.0/25], keeping [192.0.2.0/24]: NetNamespaces would lose egress IPs: app [192.0.2.130]"},
+		{"removed", "", false, []v1.HostSubnetEgressCIDR{"192.0.2.0/24"},
+			"Warning EgressCIDRsInUse Refusing egress CIDRs [], keeping [192.0.2.0/24]"},
+		{"forced", "192.0.2.0/25", true, []v1.HostSubnetEgressCIDR{"192.0.2.0/25"},
+			"Warning EgressCIDRsInUse Forced change of egress CIDRs to [192.0.2.0/25], NetNamespaces lose egress IPs: app [192.0.2.130]"},
+		{"forced removal", "", true, nil,
+			"Warning EgressCIDRsInUse Forced change of egress CIDRs to []"},
+		{"kept", "192.0.2.128/25", false, []v1.HostSubnetEgressCIDR{"192.0.2.128/25"}, ""},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			is := is.New(t)
+			recorder := record.NewFakeRecorder(10)
+			ctrl := controller.NewTestController(mockOptions(controller.ReleaseKeep), recorder, netns)
+			old := mockMachineSet("foo", nil, "192.0.2.0/24")
+			ctrl.AddMachineSet(old)
+			is.Equal(ctrl.CIDRs().Get("foo"), []v1.HostSubnetEgressCIDR{"192.0.2.0/24"})
+
+			ms := mockMachineSet("foo", nil, c.CIDRs)
+			if c.Force {
+				ms.SetAnnotations(map[string]string{controller.AnnotationForceCIDRs: "true"})
+				if c.CIDRs != "" {
+					ms.Annotations[controller.AnnotationEgressCIDRS] = c.CIDRs
+				}
+			}
+			ctrl.UpdateMachineSet(old, ms)
+			is.Equal(ctrl.CIDRs().Get("foo"), c.Expected)
+
+			events := make([]string, 0)
+			for len(recorder.Events) > 0 {
+				events = append(events, <-recorder.Events)
+			}
+			if c.Event == "" {
+				is.Equal(events, []string{})
+				return
+			}
+			is.Equal(len(events), 1)
+			is.True(strings.HasPrefix(events[0], c.Event)) // event
+		})
+	}
+}
+
+func TestGuardCIDRMap(t *testing.T) {
+	netNamespaces := []*v1.NetNamespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "app"}, EgressIPs: []v1.NetNamespaceEgressIP{"192.0.2.130", "203.0.113.5"}},
+	}
+	hostSubnets := []*v1.HostSubnet{
+		mockManagedSubnet("node01", "shrunk", "192.0.2.0/24"),
+		mockManagedSubnet("node02", "forced", "192.0.2.0/24"),
+		mockManagedSubnet("node03", controller.NodeKey("node03"), "203.0.113.0/24"),
+		mockManagedSubnet("node04", "moved", "198.51.100.0/24"),
+	}
+	forced := mockMachineSet("forced", nil, "192.0.2.0/25")
+	forced.Annotations[controller.AnnotationForceCIDRs] = "true"
+	machineSets := []*v1beta1.MachineSet{
+		mockMachineSet("shrunk", nil, "192.0.2.0/25"),
+		forced,
+		mockMachineSet("moved", nil, "198.51.100.0/25"),
+	}
+	node := mockNode("node03", "")
+	policy := mockPolicy("policy", 0, "198.51.100.0/24")
+	policy.Spec.NodeSelector = &metav1.LabelSelector{}
+
+	for _, c := range []struct {
+		Name     string
+		Force    bool
+		Errors   int
+		Expected []v1.HostSubnetEgressCIDR
+	}{
+		{"refused", false, 3, []v1.HostSubnetEgressCIDR{"203.0.113.0/24"}},
+		{"forced by policy", true, 3, []v1.HostSubnetEgressCIDR{"198.51.100.0/24"}},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			is := is.New(t)
+			p := policy.DeepCopy()
+			if c.Force {
+				p.SetAnnotations(map[string]string{controller.AnnotationForceCIDRs: "true"})
+			}
+			policies := []*v1alpha1.EgressCIDRPolicy{p}
+			opts := mockOptions(controller.ReleaseKeep)
+			cidrs, _ := controller.BuildCIDRMap(opts, nil, machineSets, policies, []*corev1.Node{node})
+
+			errs := controller.GuardCIDRMap(opts, cidrs, hostSubnets, netNamespaces, machineSets, policies, []*corev1.Node{node})
+			is.Equal(len(errs), c.Errors)                                              // shrunk, forced and node03
+			is.Equal(cidrs.Get("shrunk"), []v1.HostSubnetEgressCIDR{"192.0.2.0/24"})   // refused
+			is.Equal(cidrs.Get("forced"), []v1.HostSubnetEgressCIDR{"192.0.2.0/25"})   // forced
+			is.Equal(cidrs.Get("moved"), []v1.HostSubnetEgressCIDR{"198.51.100.0/25"}) // no egress IPs lost
+			is.Equal(cidrs.Get(controller.NodeKey("node03")), c.Expected)
+		})
+	}
+}
+
+func mockManagedSubnet(name, managedBy string, cidrs ...v1.HostSubnetEgressCIDR) *v1.HostSubnet {
+	hs := mockHostSubnet(name)
+	hs.EgressCIDRs = cidrs
+	hs.SetAnnotations(map[string]string{controller.AnnotationManagedBy: managedBy})
+	return hs
+}
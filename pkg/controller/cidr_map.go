@@ -1,8 +1,12 @@
 package controller
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"regexp"
 	"sort"
+	"strings"
 	"sync"
 
 	v1 "github.com/openshift/api/network/v1"
@@ -10,7 +14,15 @@ import (
 
 type CIDRMap struct {
 	entries map[string][]v1.HostSubnetEgressCIDR
-	mutex   *sync.RWMutex
+	release map[string]ReleasePolicy
+	// ips are the egress IPs of each MachineSet, assignments how they are
+	// spread across its nodes, stale the assignments to recompute
+	ips         map[string][]v1.HostSubnetEgressIP
+	assignments map[string]map[string][]v1.HostSubnetEgressIP
+	stale       map[string]bool
+	// reserved are the networks no entry may collide with
+	reserved []ReservedNetwork
+	mutex    *sync.RWMutex
 }
 
 var (
@@ -19,26 +31,125 @@ var (
 
 func NewCIDRMap() *CIDRMap {
 	return &CIDRMap{
-		entries: make(map[string][]v1.HostSubnetEgressCIDR),
-		mutex:   new(sync.RWMutex),
+		entries:     make(map[string][]v1.HostSubnetEgressCIDR),
+		release:     make(map[string]ReleasePolicy),
+		ips:         make(map[string][]v1.HostSubnetEgressIP),
+		assignments: make(map[string]map[string][]v1.HostSubnetEgressIP),
+		stale:       make(map[string]bool),
+		mutex:       new(sync.RWMutex),
 	}
 }
 
-// Set takes a list of (comma separated) values, splits and sorts them, and
-// then inserts them into the cache for `machineSetName`.
-func (m *CIDRMap) Set(machineSetName, s string) {
-	cidrs := splitCIDRs(s)
+// InvalidCIDRError describes a single entry of a CIDR list that could not be
+// parsed.
+type InvalidCIDRError struct {
+	Entry string
+	Err   error
+}
+
+func (e *InvalidCIDRError) Error() string {
+	return fmt.Sprintf("invalid CIDR %q: %s", e.Entry, e.Err)
+}
 
+func (e *InvalidCIDRError) Unwrap() error {
+	return e.Err
+}
+
+// CIDRListError is returned for a CIDR list that contains invalid entries.
+type CIDRListError struct {
+	Errors []*InvalidCIDRError
+}
+
+func (e *CIDRListError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i := range e.Errors {
+		msgs[i] = e.Errors[i].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+var (
+	errNotIPv4 = errors.New("not an IPv4 network")
+	errNoCIDRs = errors.New("no CIDRs, use \"none\" to remove all")
+)
+
+// Set takes a list of (comma separated) values, validates, canonicalizes and
+// sorts them, and then inserts them into the cache for `machineSetName`.
+// If any of the values is invalid, a *CIDRListError is returned, if any
+// collides with a reserved network a *ReservedCIDRError. In both cases the
+// cache is left untouched.
+func (m *CIDRMap) Set(machineSetName, s string) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	cidrs, err := m.parse(s)
+	if err != nil {
+		return err
+	}
 	m.entries[machineSetName] = cidrs
+	return nil
+}
+
+// SetReserved sets the networks entries must not collide with. Existing
+// entries are not checked again.
+func (m *CIDRMap) SetReserved(networks []ReservedNetwork) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.reserved = networks
+}
+
+// Reserved returns the networks set by SetReserved.
+func (m *CIDRMap) Reserved() []ReservedNetwork {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.reserved
+}
+
+// Validate returns the error Set would return for `s`.
+func (m *CIDRMap) Validate(s string) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, err := m.parse(s)
+	return err
+}
+
+// parse parses `s` and checks it against the reserved networks. The caller
+// must hold the mutex.
+func (m *CIDRMap) parse(s string) ([]v1.HostSubnetEgressCIDR, error) {
+	cidrs, err := parseCIDRs(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkReserved(m.reserved, cidrs); err != nil {
+		return nil, err
+	}
+	return cidrs, nil
+}
+
+// SetReleasePolicy sets the ReleasePolicy recorded on HostSubnets managed
+// through the entry for `machineSetName`.
+func (m *CIDRMap) SetReleasePolicy(machineSetName string, policy ReleasePolicy) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.release[machineSetName] = policy
+}
+
+// ReleasePolicy returns the ReleasePolicy for `machineSetName`, defaulting to
+// ReleaseKeep.
+func (m *CIDRMap) ReleasePolicy(machineSetName string) ReleasePolicy {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if policy, ok := m.release[machineSetName]; ok {
+		return policy
+	}
+	return ReleaseKeep
 }
 
 func (m *CIDRMap) Delete(machineSetName string) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	delete(m.entries, machineSetName)
+	delete(m.release, machineSetName)
 }
 
 func (m *CIDRMap) Exists(machineSetName string) bool {
@@ -59,10 +170,13 @@ func (m *CIDRMap) Get(machineSetName string) []v1.HostSubnetEgressCIDR {
 	return entries
 }
 
-// Equals returns true if the splitted, sorted value of v is equal to the entry
-// in the cache for `machineSetName`.
+// Equals returns true if the parsed, sorted value of v is equal to the entry
+// in the cache for `machineSetName`. An invalid v is never equal.
 func (m *CIDRMap) Equals(machineSetName, v string) bool {
-	other := splitCIDRs(v)
+	other, err := parseCIDRs(v)
+	if err != nil {
+		return false
+	}
 
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
@@ -72,13 +186,299 @@ func (m *CIDRMap) Equals(machineSetName, v string) bool {
 }
 
 func (m *CIDRMap) EqualCIRDs(machineSetName string, other []v1.HostSubnetEgressCIDR) bool {
-	s := egressCIDRsToStrings(other)
-	sort.Strings(s)
-	other = stringsToEgressCIDRs(s)
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return equalCIDRs(m.entries[machineSetName], other)
+}
 
+// SetIPs takes a list of (comma separated) egress IPs for `machineSetName`.
+// An error is returned and the cache left untouched if any of them is
+// invalid, collides with a reserved network, is within the CIDRs of an entry
+// or is listed by another MachineSet. The assignment is kept until the next
+// SetAssignment, so IPs which are still listed stay where they are.
+func (m *CIDRMap) SetIPs(machineSetName, s string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ips, err := parseEgressIPs(s)
+	if err != nil {
+		return err
+	}
+	hosts := hostCIDRs(ips)
+	if err := checkReserved(m.reserved, hosts); err != nil {
+		return err
+	}
+	for _, key := range m.sortedKeys() {
+		if overlaps := overlapping(key, m.entries[key], machineSetName, hosts); len(overlaps) > 0 {
+			return fmt.Errorf("%s is within the egress CIDR %s of %s",
+				strings.TrimSuffix(overlaps[0].OtherCIDR, "/32"), overlaps[0].CIDR, key)
+		}
+	}
+	for _, other := range m.sortedIPKeys() {
+		if other == machineSetName {
+			continue
+		}
+		for _, ip := range ips {
+			if containsIP(m.ips[other], ip) {
+				return fmt.Errorf("%s is already an egress IP of MachineSet %s", ip, other)
+			}
+		}
+	}
+	m.ips[machineSetName] = ips
+	m.stale[machineSetName] = true
+	return nil
+}
+
+// IPs returns the egress IPs of `machineSetName`.
+func (m *CIDRMap) IPs(machineSetName string) []v1.HostSubnetEgressIP {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
-	this := m.entries[machineSetName]
+	return m.ips[machineSetName]
+}
+
+// HasIPs returns true if `machineSetName` has egress IPs.
+func (m *CIDRMap) HasIPs(machineSetName string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, ok := m.ips[machineSetName]
+	return ok
+}
+
+// EqualIPs returns true if the parsed value of `s` is equal to the egress IPs
+// of `machineSetName`. An invalid `s` is never equal.
+func (m *CIDRMap) EqualIPs(machineSetName, s string) bool {
+	ips, err := parseEgressIPs(s)
+	if err != nil {
+		return false
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	current, ok := m.ips[machineSetName]
+	return ok && equalIPs(current, ips)
+}
+
+// AllIPs returns the egress IPs of all MachineSets.
+func (m *CIDRMap) AllIPs() []v1.HostSubnetEgressIP {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	all := make([]v1.HostSubnetEgressIP, 0)
+	for _, ips := range m.ips {
+		all = append(all, ips...)
+	}
+	return all
+}
+
+// DeleteIPs removes the egress IPs of `machineSetName` and their assignment.
+func (m *CIDRMap) DeleteIPs(machineSetName string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.ips, machineSetName)
+	delete(m.assignments, machineSetName)
+	delete(m.stale, machineSetName)
+}
+
+// MarkAssignmentStale flags the assignment of `machineSetName` to be
+// recomputed, e.g. because the nodes of the MachineSet changed. SetIPs does
+// so by itself.
+func (m *CIDRMap) MarkAssignmentStale(machineSetName string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.ips[machineSetName]; ok {
+		m.stale[machineSetName] = true
+	}
+}
+
+// ClaimStaleAssignment returns true if `machineSetName` has egress IPs and no
+// assignment, or a stale one, and clears the flag. The caller is expected to
+// recompute the assignment, and to mark it stale again if it fails to.
+func (m *CIDRMap) ClaimStaleAssignment(machineSetName string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.ips[machineSetName]; !ok {
+		return false
+	}
+	_, assigned := m.assignments[machineSetName]
+	stale := m.stale[machineSetName] || !assigned
+	delete(m.stale, machineSetName)
+	return stale
+}
+
+// SetAssignment stores how the egress IPs of `machineSetName` are spread
+// across its nodes. Returns true if the assignment changed.
+func (m *CIDRMap) SetAssignment(machineSetName string, assignment map[string][]v1.HostSubnetEgressIP) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	current, ok := m.assignments[machineSetName]
+	m.assignments[machineSetName] = assignment
+	if !ok || len(current) != len(assignment) {
+		return true
+	}
+	for node, ips := range assignment {
+		if other, ok := current[node]; !ok || !equalIPs(ips, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// Assignment returns the assignment set by SetAssignment, and false if there
+// is none.
+func (m *CIDRMap) Assignment(machineSetName string) (map[string][]v1.HostSubnetEgressIP, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	assignment, ok := m.assignments[machineSetName]
+	return assignment, ok
+}
+
+// AssignedIPs returns the egress IPs assigned to `node` from
+// `machineSetName`, and false if the MachineSet has no assignment.
+func (m *CIDRMap) AssignedIPs(machineSetName, node string) ([]v1.HostSubnetEgressIP, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	assignment, ok := m.assignments[machineSetName]
+	if !ok {
+		return nil, false
+	}
+	if ips, ok := assignment[node]; ok {
+		return ips, true
+	}
+	return []v1.HostSubnetEgressIP{}, true
+}
+
+func (m *CIDRMap) sortedIPKeys() []string {
+	keys := make([]string, 0, len(m.ips))
+	for key := range m.ips {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// hostCIDRs returns `ips` as /32 CIDRs.
+func hostCIDRs(ips []v1.HostSubnetEgressIP) []v1.HostSubnetEgressCIDR {
+	hosts := make([]v1.HostSubnetEgressCIDR, len(ips))
+	for i, ip := range ips {
+		hosts[i] = v1.HostSubnetEgressCIDR(ip + "/32")
+	}
+	return hosts
+}
+
+func containsIP(ips []v1.HostSubnetEgressIP, ip v1.HostSubnetEgressIP) bool {
+	for _, other := range ips {
+		if other == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// Overlap describes two CIDRs of different entries which share addresses,
+// either because they are equal or because one contains the other.
+type Overlap struct {
+	Key, CIDR           string
+	OtherKey, OtherCIDR string
+}
+
+func (o Overlap) String() string {
+	return fmt.Sprintf("%s of %s overlaps %s of %s", o.CIDR, o.Key, o.OtherCIDR, o.OtherKey)
+}
+
+// Overlapping returns the overlaps between the comma separated list of CIDRs
+// `s` and all entries except the one for `key`, including the egress IPs of
+// other MachineSets as /32 CIDRs. An `s` rejected by Set has no overlaps.
+func (m *CIDRMap) Overlapping(key, s string) []Overlap {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	cidrs, err := m.parse(s)
+	if err != nil {
+		return nil
+	}
+
+	keys := m.sortedKeys()
+	overlaps := make([]Overlap, 0)
+	for _, other := range keys {
+		if other == key {
+			continue
+		}
+		overlaps = append(overlaps, overlapping(key, cidrs, other, m.entries[other])...)
+	}
+	for _, other := range m.sortedIPKeys() {
+		if other == key {
+			continue
+		}
+		overlaps = append(overlaps, overlapping(key, cidrs, other, hostCIDRs(m.ips[other]))...)
+	}
+	return overlaps
+}
+
+// Overlaps returns all overlaps between entries, and between entries and the
+// egress IPs of other MachineSets as /32 CIDRs, as Overlapping does. Each
+// pair of entries is reported once, with Key sorting before OtherKey. For
+// egress IPs, OtherKey is the MachineSet they belong to.
+func (m *CIDRMap) Overlaps() []Overlap {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	keys := m.sortedKeys()
+	ipKeys := m.sortedIPKeys()
+	overlaps := make([]Overlap, 0)
+	for i, key := range keys {
+		for _, other := range keys[i+1:] {
+			overlaps = append(overlaps, overlapping(key, m.entries[key], other, m.entries[other])...)
+		}
+		for _, other := range ipKeys {
+			if other == key {
+				continue
+			}
+			overlaps = append(overlaps, overlapping(key, m.entries[key], other, hostCIDRs(m.ips[other]))...)
+		}
+	}
+	return overlaps
+}
+
+func (m *CIDRMap) sortedKeys() []string {
+	keys := make([]string, 0, len(m.entries))
+	for key := range m.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// overlapping compares two parsed lists of CIDRs.
+func overlapping(key string, cidrs []v1.HostSubnetEgressCIDR, otherKey string, others []v1.HostSubnetEgressCIDR) []Overlap {
+	var overlaps []Overlap
+	for _, a := range cidrs {
+		_, netA, err := net.ParseCIDR(string(a))
+		if err != nil {
+			// "none"
+			continue
+		}
+		for _, b := range others {
+			_, netB, err := net.ParseCIDR(string(b))
+			if err != nil {
+				continue
+			}
+			if netA.Contains(netB.IP) || netB.Contains(netA.IP) {
+				overlaps = append(overlaps, Overlap{
+					Key: key, CIDR: string(a),
+					OtherKey: otherKey, OtherCIDR: string(b),
+				})
+			}
+		}
+	}
+	return overlaps
+}
+
+// equalCIDRs compares a parsed list of CIDRs with an unsorted list as found on
+// a HostSubnet.
+func equalCIDRs(this, other []v1.HostSubnetEgressCIDR) bool {
+	s := egressCIDRsToStrings(other)
+	sort.Strings(s)
+	other = stringsToEgressCIDRs(s)
 
 	if len(this) == 1 && this[0] == "none" {
 		return len(other) == 0
@@ -87,16 +487,57 @@ func (m *CIDRMap) EqualCIRDs(machineSetName string, other []v1.HostSubnetEgressC
 	return compare(this, other)
 }
 
-func splitCIDRs(s string) []v1.HostSubnetEgressCIDR {
+// parseCIDRs splits a comma separated list of CIDRs and normalizes each entry
+// to its network address (192.0.2.5/24 becomes 192.0.2.0/24). The result is
+// sorted and free of duplicates. The special value "none" is passed through,
+// a list made only of separators is invalid.
+func parseCIDRs(s string) ([]v1.HostSubnetEgressCIDR, error) {
+	s = strings.TrimSpace(s)
+
 	// edge case: When splitting "", Split will return a slice with a single
 	// empty string, whereas we want a slice of length 0.
 	if s == "" {
-		return make([]v1.HostSubnetEgressCIDR, 0)
+		return make([]v1.HostSubnetEgressCIDR, 0), nil
+	}
+	if s == "none" {
+		return []v1.HostSubnetEgressCIDR{"none"}, nil
+	}
+
+	seen := make(map[string]bool)
+	v := make([]string, 0)
+	listErr := new(CIDRListError)
+	for _, entry := range splitRe.Split(s, -1) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err == nil && ipnet.IP.To4() == nil {
+			err = errNotIPv4
+		}
+		if err != nil {
+			listErr.Errors = append(listErr.Errors, &InvalidCIDRError{Entry: entry, Err: err})
+			continue
+		}
+
+		cidr := ipnet.String()
+		if !seen[cidr] {
+			seen[cidr] = true
+			v = append(v, cidr)
+		}
+	}
+
+	if len(listErr.Errors) == 0 && len(v) == 0 {
+		// Only separators, most likely a mistake rather than a release
+		listErr.Errors = append(listErr.Errors, &InvalidCIDRError{Entry: s, Err: errNoCIDRs})
+	}
+	if len(listErr.Errors) > 0 {
+		return nil, listErr
 	}
 
-	v := splitRe.Split(s, -1)
 	sort.Strings(v)
-	return stringsToEgressCIDRs(v)
+	return stringsToEgressCIDRs(v), nil
 }
 
 func stringsToEgressCIDRs(s []string) []v1.HostSubnetEgressCIDR {
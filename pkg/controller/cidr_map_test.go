@@ -1,6 +1,7 @@
 package controller_test
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
@@ -17,17 +18,20 @@ func TestCIDRMap(t *testing.T) {
 		Name, Input string
 		Expected    []v1.HostSubnetEgressCIDR
 	}{
-		{"simple", "foo", []v1.HostSubnetEgressCIDR{"foo"}},
-		{"no-space", "foo,bar", []v1.HostSubnetEgressCIDR{"bar", "foo"}},
-		{"one-space", "ggg, aaa", []v1.HostSubnetEgressCIDR{"aaa", "ggg"}},
-		{"multiple-spaces", "one,   two", []v1.HostSubnetEgressCIDR{"one", "two"}},
-		{"tabs", "tab,	ulator", []v1.HostSubnetEgressCIDR{"tab", "ulator"}},
+		{"simple", "192.0.2.0/24", []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}},
+		{"no-space", "203.0.113.0/24,192.0.2.0/24", []v1.HostSubnetEgressCIDR{"192.0.2.0/24", "203.0.113.0/24"}},
+		{"one-space", "203.0.113.0/24, 192.0.2.0/24", []v1.HostSubnetEgressCIDR{"192.0.2.0/24", "203.0.113.0/24"}},
+		{"multiple-spaces", "192.0.2.0/24,   198.51.100.0/24", []v1.HostSubnetEgressCIDR{"192.0.2.0/24", "198.51.100.0/24"}},
+		{"tabs", "192.0.2.0/24,	198.51.100.0/24", []v1.HostSubnetEgressCIDR{"192.0.2.0/24", "198.51.100.0/24"}},
+		{"trailing-comma", "192.0.2.0/24,", []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}},
+		{"host-bits", "192.0.2.5/24", []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}},
+		{"duplicates", "192.0.2.0/24,192.0.2.0/24, 192.0.2.128/24", []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}},
 		{"none", "none", []v1.HostSubnetEgressCIDR{}},
 	} {
 		t.Run(c.Name, func(t *testing.T) {
 			is := is.New(t)
 
-			cm.Set(c.Name, c.Input)
+			is.NoErr(cm.Set(c.Name, c.Input))
 
 			is.Equal(c.Expected, cm.Get(c.Name))
 			is.True(cm.Exists(c.Name))
@@ -45,7 +49,7 @@ func TestCIDRMapEmptyString(t *testing.T) {
 	is := is.New(t)
 	cm := controller.NewCIDRMap()
 
-	cm.Set("foo", "")
+	is.NoErr(cm.Set("foo", ""))
 	is.True(!cm.Exists("foo"))
 }
 
@@ -53,7 +57,101 @@ func TestCIDRMapEqualCIDRs(t *testing.T) {
 	is := is.New(t)
 	cm := controller.NewCIDRMap()
 
-	cm.Set("foo", "none")
+	is.NoErr(cm.Set("foo", "none"))
 	is.True(cm.EqualCIRDs("foo", []v1.HostSubnetEgressCIDR{}))
 	is.True(!cm.EqualCIRDs("foo", []v1.HostSubnetEgressCIDR{"none"}))
 }
+
+func TestCIDRMapInvalid(t *testing.T) {
+	is := is.New(t)
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.Set("foo", "192.0.2.0/24"))
+
+	for _, c := range []struct {
+		Name, Input string
+		Invalid     []string
+	}{
+		{"garbage", "foo", []string{"foo"}},
+		{"no-prefix", "192.0.2.0", []string{"192.0.2.0"}},
+		{"partial", "192.0.2.0/24,foo,bar", []string{"foo", "bar"}},
+		{"ipv6", "2001:db8::/32", []string{"2001:db8::/32"}},
+		{"none-mixed", "none,192.0.2.0/24", []string{"none"}},
+		{"separators-only", " , ,", []string{", ,"}},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			is := is.New(t)
+
+			err := cm.Set("foo", c.Input)
+			var listErr *controller.CIDRListError
+			is.True(errors.As(err, &listErr))
+			is.Equal(len(listErr.Errors), len(c.Invalid))
+			for i := range c.Invalid {
+				is.Equal(listErr.Errors[i].Entry, c.Invalid[i])
+			}
+
+			// last good value is kept
+			is.Equal(cm.Get("foo"), []v1.HostSubnetEgressCIDR{"192.0.2.0/24"})
+			is.True(!cm.Equals("foo", c.Input))
+		})
+	}
+}
+
+func TestCIDRMapOverlapping(t *testing.T) {
+	is := is.New(t)
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.Set("a", "192.0.2.0/24"))
+	is.NoErr(cm.Set("b", "198.51.100.0/25"))
+	is.NoErr(cm.Set("c", "none"))
+
+	for _, c := range []struct {
+		Name, Input string
+		Expected    []controller.Overlap
+	}{
+		{"disjoint", "203.0.113.0/24", []controller.Overlap{}},
+		{"duplicate", "192.0.2.0/24", []controller.Overlap{
+			{Key: "new", CIDR: "192.0.2.0/24", OtherKey: "a", OtherCIDR: "192.0.2.0/24"},
+		}},
+		{"contained", "192.0.2.128/25", []controller.Overlap{
+			{Key: "new", CIDR: "192.0.2.128/25", OtherKey: "a", OtherCIDR: "192.0.2.0/24"},
+		}},
+		{"containing", "198.51.100.0/24,192.0.2.0/23", []controller.Overlap{
+			{Key: "new", CIDR: "192.0.2.0/23", OtherKey: "a", OtherCIDR: "192.0.2.0/24"},
+			{Key: "new", CIDR: "198.51.100.0/24", OtherKey: "b", OtherCIDR: "198.51.100.0/25"},
+		}},
+		{"adjacent", "198.51.100.128/25", []controller.Overlap{}},
+		{"none", "none", []controller.Overlap{}},
+		{"invalid", "192.0.2.0/24,foo", nil},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(cm.Overlapping("new", c.Input), c.Expected)
+		})
+	}
+
+	// an entry doesn't overlap itself
+	is.Equal(cm.Overlapping("a", "192.0.2.0/24"), []controller.Overlap{})
+}
+
+func TestCIDRMapOverlaps(t *testing.T) {
+	is := is.New(t)
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.Set("b", "192.0.2.0/25"))
+	is.NoErr(cm.Set("a", "192.0.2.0/24"))
+	is.NoErr(cm.Set("c", "203.0.113.0/24"))
+
+	is.Equal(cm.Overlaps(), []controller.Overlap{
+		{Key: "a", CIDR: "192.0.2.0/24", OtherKey: "b", OtherCIDR: "192.0.2.0/25"},
+	})
+
+	cm.Delete("b")
+	is.Equal(cm.Overlaps(), []controller.Overlap{})
+
+	// Egress IPs of other MachineSets, which SetIPs only checks against the
+	// entries at the time
+	is.NoErr(cm.SetIPs("d", "198.51.100.10"))
+	is.NoErr(cm.Set("e", "198.51.100.0/24"))
+	is.Equal(cm.Overlaps(), []controller.Overlap{
+		{Key: "e", CIDR: "198.51.100.0/24", OtherKey: "d", OtherCIDR: "198.51.100.10/32"},
+	})
+	is.Equal(cm.Overlaps(), cm.Overlapping("e", "198.51.100.0/24"))
+}
@@ -2,6 +2,9 @@ package controller
 
 import (
 	"context"
+	"reflect"
+	"sync"
+	"time"
 
 	v1 "github.com/openshift/client-go/network/clientset/versioned/typed/network/v1"
 	network "github.com/openshift/client-go/network/informers/externalversions"
@@ -10,61 +13,392 @@ import (
 	machine "github.com/openshift/machine-api-operator/pkg/generated/informers/externalversions"
 	machineInformers "github.com/openshift/machine-api-operator/pkg/generated/informers/externalversions/machine/v1beta1"
 	machineListers "github.com/openshift/machine-api-operator/pkg/generated/listers/machine/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	coreInformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 )
 
 const (
 	AnnotationEgressCIDRS = "appuio.ch/egress-cidrs"
 	LeaseLockName         = "machineset-egress-cidr-operator.appuio.ch"
+	MachineAnnotation     = "machine.openshift.io/machine"
 	MachineNamespace      = "openshift-machine-api"
 	MachinesetLabel       = "machine.openshift.io/cluster-api-machineset"
 	RoleLabel             = "machine.openshift.io/cluster-api-machine-role"
 )
 
+// Options configures a Controller.
+type Options struct {
+	// Layout must be valid, see DefaultLayout.
+	Layout Layout
+	// Workers is the number of goroutines reconciling HostSubnets.
+	Workers int
+	// DefaultReleasePolicy applies to MachineSets without
+	// AnnotationOnRelease and to EgressCIDRPolicies.
+	DefaultReleasePolicy ReleasePolicy
+	// DryRun disables all writes to HostSubnets and EgressCIDRPolicies. The
+	// changes which would have been made are logged, recorded as events and
+	// counted in metrics instead.
+	DryRun bool
+	// ResyncPeriod of all informers. Defaults to one hour.
+	ResyncPeriod time.Duration
+	// NetworkType selects where egress CIDRs are written to. Defaults to
+	// NetworkTypeOpenShiftSDN.
+	NetworkType NetworkType
+	// DisablePolicies turns off support for EgressCIDRPolicies, even if the
+	// API is available.
+	DisablePolicies bool
+	// StrictOverlaps refuses MachineSet annotations and policy CIDRs which
+	// overlap with those of another MachineSet or policy. Otherwise overlaps
+	// are only reported.
+	StrictOverlaps bool
+	// ShutdownTimeout bounds how long Run waits for in-flight updates once
+	// its context is done. Defaults to 10 seconds.
+	ShutdownTimeout time.Duration
+	// StallTimeout is how long queued items may wait without any worker
+	// making progress before /livez fails. Defaults to 5 minutes.
+	StallTimeout time.Duration
+	// Allocations is the ConfigMap persisting the egress IPs allocated to
+	// NetNamespaces. Egress IP allocation is disabled if the Name is empty,
+	// and only supported with NetworkTypeOpenShiftSDN.
+	Allocations types.NamespacedName
+}
+
+// settings are the Options which can be changed at runtime, see Reload.
+type settings struct {
+	layout         Layout
+	defaultRelease ReleasePolicy
+	dryRun         bool
+	strictOverlaps bool
+}
+
 type Controller struct {
-	cidrs *CIDRMap
+	cidrs        *CIDRMap
+	queue        workqueue.RateLimitingInterface
+	workers      int
+	resyncPeriod time.Duration
+	// shutdownTimeout bounds the time Run waits for the workers to finish
+	shutdownTimeout time.Duration
+	stallTimeout    time.Duration
+	health          *health
+	target          egressTarget
+	networkType     NetworkType
+
+	settings      settings
+	settingsMutex sync.RWMutex
 
 	machineInformerFactory machine.SharedInformerFactory
 	networkInformerFactory network.SharedInformerFactory
+	kubeInformerFactory    informers.SharedInformerFactory
+	dynamicInformerFactory dynamicinformer.DynamicSharedInformerFactory
 
 	machineSetInformer machineInformers.MachineSetInformer
 	machineInformer    machineInformers.MachineInformer
 	hostSubNetInformer networkInformers.HostSubnetInformer
+	nodeInformer       coreInformers.NodeInformer
+	// policyInformer is nil if the EgressCIDRPolicy API is not available
+	policyInformer informers.GenericInformer
+
+	index *MachineNodeIndex
 
 	machines         machineListers.MachineNamespaceLister
 	machineSets      machineListers.MachineSetNamespaceLister
 	hostSubnets      networkListers.HostSubnetLister
 	hostSubnetClient v1.HostSubnetInterface
+	policyClient     dynamic.NamespaceableResourceInterface
+
+	policyQueue workqueue.RateLimitingInterface
+	// policyKeys are the CIDRMap keys set from policies, as opposed to keys
+	// set from MachineSet annotations, with the name of the policy
+	policyKeys  map[string]string
+	policyMutex sync.Mutex
+	// assignMutex serializes the egress IP assignments of the workers
+	assignMutex sync.Mutex
+
+	// ipamQueue is nil if egress IP allocation is disabled
+	ipamQueue            workqueue.RateLimitingInterface
+	namespaceInformer    coreInformers.NamespaceInformer
+	netNamespaceInformer networkInformers.NetNamespaceInformer
+	// netNamespaces is nil on OVN-Kubernetes
+	netNamespaces      networkListers.NetNamespaceLister
+	netNamespaceClient v1.NetNamespaceInterface
+	allocationStore    types.NamespacedName
+	// allocations are the egress IPs allocated to namespaces, by namespace
+	allocations     Allocations
+	allocationMutex sync.Mutex
+	// persistMutex serializes changes to the allocations with writing them
+	// to the ConfigMap, without blocking readers of the allocations
+	persistMutex sync.Mutex
+
+	kubeClient       kubernetes.Interface
+	eventBroadcaster record.EventBroadcaster
+	recorder         record.EventRecorder
 
 	config *rest.Config
 }
 
-func New(config *rest.Config) *Controller {
+func New(config *rest.Config, opts Options) *Controller {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	resyncPeriod := opts.ResyncPeriod
+	if resyncPeriod <= 0 {
+		resyncPeriod = time.Hour
+	}
+	shutdownTimeout := opts.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = 10 * time.Second
+	}
+	stallTimeout := opts.StallTimeout
+	if stallTimeout <= 0 {
+		stallTimeout = 5 * time.Minute
+	}
+
 	c := &Controller{
-		cidrs:  NewCIDRMap(),
-		config: config,
+		cidrs:           NewCIDRMap(),
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "hostsubnets"),
+		workers:         workers,
+		resyncPeriod:    resyncPeriod,
+		shutdownTimeout: shutdownTimeout,
+		stallTimeout:    stallTimeout,
+		health:          newHealth(),
+		settings: settings{
+			layout:         opts.Layout,
+			defaultRelease: opts.DefaultReleasePolicy,
+			dryRun:         opts.DryRun,
+			strictOverlaps: opts.StrictOverlaps,
+		},
+		policyQueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "egresscidrpolicies"),
+		policyKeys:  make(map[string]string),
+		kubeClient:  kubernetes.NewForConfigOrDie(config),
+		config:      config,
 	}
 
+	c.createRecorder()
 	c.createMachineInformer()
-	c.createNetworkInformer()
+	c.createNodeInformer()
+	networkType := opts.NetworkType
+	if networkType == "" {
+		networkType = NetworkTypeOpenShiftSDN
+	}
+	target, err := c.newTarget(networkType)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	c.target = target
+	c.networkType = networkType
+	klog.Infof("Writing egress CIDRs for network type %s", networkType)
+	if opts.DisablePolicies {
+		klog.Info("EgressCIDRPolicies disabled")
+	} else {
+		c.createPolicyInformer()
+	}
+	switch {
+	case opts.Allocations.Name == "":
+		klog.Info("Egress IP allocation disabled")
+	case networkType != NetworkTypeOpenShiftSDN:
+		klog.Warningf("Egress IP allocation disabled, only supported with %s", NetworkTypeOpenShiftSDN)
+	default:
+		c.createAllocator(opts.Allocations)
+	}
+
+	c.health.watchInformer("machines", c.machineInformer.Informer())
+	c.health.watchInformer("machinesets", c.machineSetInformer.Informer())
+	c.health.watchInformer("nodes", c.nodeInformer.Informer())
+	if c.policyInformer != nil {
+		c.health.watchInformer("egresscidrpolicies", c.policyInformer.Informer())
+	}
+
+	c.index = NewMachineNodeIndex(
+		c.machineInformer.Informer().GetIndexer(),
+		c.nodeInformer.Informer().GetIndexer(),
+	)
 
 	return c
 }
 
+// deletedObject returns the object passed to a DeleteFunc. If the watch
+// missed the deletion, it's wrapped in a cache.DeletedFinalStateUnknown.
+func deletedObject(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
+}
+
+// current returns the settings in effect.
+func (c *Controller) current() settings {
+	c.settingsMutex.RLock()
+	defer c.settingsMutex.RUnlock()
+	return c.settings
+}
+
+// Reload applies the Layout, DefaultReleasePolicy, DryRun and StrictOverlaps
+// of `opts` and reconciles everything again if any of them changed. The
+// MachineNamespace and all other Options are only read by New.
+func (c *Controller) Reload(opts Options) {
+	c.settingsMutex.Lock()
+	old := c.settings
+	layout := opts.Layout
+	layout.MachineNamespace = old.layout.MachineNamespace
+	c.settings = settings{
+		layout:         layout,
+		defaultRelease: opts.DefaultReleasePolicy,
+		dryRun:         opts.DryRun,
+		strictOverlaps: opts.StrictOverlaps,
+	}
+	changed := !reflect.DeepEqual(old, c.settings)
+	c.settingsMutex.Unlock()
+
+	if changed {
+		klog.Info("Settings changed, reconciling everything")
+		c.resyncAll()
+	}
+}
+
+// resyncAll rebuilds the CIDRMap and enqueues all nodes.
+func (c *Controller) resyncAll() {
+	machineSets, err := c.machineSets.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("list machinesets: %s", err)
+	}
+	for _, ms := range machineSets {
+		c.syncMachineSet(ms)
+		// The layout decides which nodes take part
+		c.invalidateAssignment(ms.Name)
+	}
+	c.enqueuePolicySync()
+
+	nodes, err := c.target.nodes()
+	if err != nil {
+		klog.Errorf("list nodes: %s", err)
+	}
+	for _, node := range nodes {
+		c.enqueue(node)
+	}
+}
+
+// populateCIDRMap fills the CIDRMap from all MachineSets and policies. It
+// must run before any worker starts: the informer handlers do the same, but
+// may lag behind the synced caches, and a worker would take a missing entry
+// for a removed one and release the HostSubnets or allocations using it.
+func (c *Controller) populateCIDRMap(ctx context.Context) {
+	machineSets, err := c.machineSets.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("list machinesets: %s", err)
+	}
+	for _, ms := range machineSets {
+		c.syncMachineSet(ms)
+	}
+
+	if c.policyInformer != nil {
+		if err := c.syncPolicies(ctx); err != nil {
+			klog.Errorf("EgressCIDRPolicies: %s", err)
+		}
+	}
+}
+
+// Run starts the informers and workers and blocks until `ctx` is done. It
+// then stops taking new work and waits up to the shutdown timeout for
+// in-flight updates before aborting them. No writes happen after Run returns.
 func (c *Controller) Run(ctx context.Context) {
-	// Doing the Machine(Set) sync first to ensure our CIDR cache is warmed up
+	c.health.setRunning(true, false)
+	defer c.health.setRunning(false, false)
+
+	// The reserved networks must be known before the first annotation is
+	// read
+	if !c.loadReserved(ctx) {
+		klog.Info("Shut down before reserved networks were loaded")
+		return
+	}
+
+	// Doing the Machine(Set) and Node sync first to ensure our CIDR cache and
+	// Machine<->Node index are warmed up
 	c.machineInformerFactory.Start(ctx.Done())
+	c.kubeInformerFactory.Start(ctx.Done())
 	if !cache.WaitForCacheSync(ctx.Done(),
 		c.machineInformer.Informer().HasSynced,
 		c.machineSetInformer.Informer().HasSynced,
+		c.nodeInformer.Informer().HasSynced,
 	) {
-		klog.Fatal("Failed to do initial Machine sync")
+		klog.Info("Shut down before initial Machine sync")
+		return
+	}
+
+	if !c.target.start(ctx) {
+		klog.Info("Shut down before initial Network sync")
+		return
+	}
+
+	// writeCtx outlives ctx, so in-flight updates can finish
+	writeCtx, abortWrites := context.WithCancel(context.Background())
+	defer abortWrites()
+	var workers sync.WaitGroup
+	startWorker := func(run func(context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(func() { run(writeCtx) }, time.Second, ctx.Done())
+		}()
+	}
+
+	if c.policyInformer != nil {
+		c.dynamicInformerFactory.Start(ctx.Done())
+		if !cache.WaitForCacheSync(ctx.Done(), c.policyInformer.Informer().HasSynced) {
+			klog.Info("Shut down before initial EgressCIDRPolicy sync")
+			return
+		}
+	}
+	c.populateCIDRMap(writeCtx)
+
+	if c.ipamQueue != nil && !c.startAllocator(ctx) {
+		klog.Info("Shut down before egress IP allocations were loaded")
+		return
+	}
+
+	if c.policyInformer != nil {
+		startWorker(c.runPolicyWorker)
+	}
+	if c.ipamQueue != nil {
+		startWorker(c.runIPAMWorker)
+	}
+
+	c.health.setRunning(true, true)
+	klog.Infof("Starting %d workers", c.workers)
+	for i := 0; i < c.workers; i++ {
+		startWorker(c.runWorker)
+	}
+
+	<-ctx.Done()
+	klog.Info("Shutting down, waiting for in-flight updates")
+	c.queue.ShutDown()
+	c.policyQueue.ShutDown()
+	if c.ipamQueue != nil {
+		c.ipamQueue.ShutDown()
 	}
 
-	c.networkInformerFactory.Start(ctx.Done())
-	if !cache.WaitForCacheSync(ctx.Done(), c.hostSubNetInformer.Informer().HasSynced) {
-		klog.Fatal("Failed to do initial Network sync")
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(c.shutdownTimeout):
+		klog.Errorf("Workers did not stop within %s, aborting in-flight updates", c.shutdownTimeout)
+		abortWrites()
+		<-stopped
 	}
+	klog.Info("All workers stopped")
 }
@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"context"
+
+	v1 "github.com/openshift/api/network/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// patcher returns the HostSubnetPatcher used by the workers. Patches are sent
+// with `ctx`, regardless of the context passed by the caller.
+func (c *Controller) patcher(ctx context.Context, dryRun bool) HostSubnetPatcher {
+	return func(_ context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*v1.HostSubnet, error) {
+		if dryRun {
+			c.dryRunPatch("HostSubnet", name, pt, data)
+			return nil, nil
+		}
+		return c.timedPatch(ctx, name, pt, data, opts, subresources...)
+	}
+}
+
+// nodePatcher returns the NodePatcher used by the workers. Patches are sent
+// with `ctx`, regardless of the context passed by the caller.
+func (c *Controller) nodePatcher(ctx context.Context, dryRun bool) NodePatcher {
+	return func(_ context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*corev1.Node, error) {
+		if dryRun {
+			c.dryRunPatch("Node", name, pt, data)
+			return nil, nil
+		}
+		return c.kubeClient.CoreV1().Nodes().Patch(ctx, name, pt, data, opts, subresources...)
+	}
+}
+
+// dryRunPatch only logs and counts a patch of the `kind` object `name`.
+func (c *Controller) dryRunPatch(kind, name string, pt types.PatchType, data []byte) {
+	klog.Infof("%s<%s>: dry run, not applying %s: %s", kind, name, pt, data)
+	dryRunPatches.WithLabelValues(c.machineSetForNode(name)).Inc()
+}
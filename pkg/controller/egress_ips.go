@@ -0,0 +1,414 @@
+package controller
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+
+	v1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// AnnotationEgressIPs is the default Layout.EgressIPsAnnotation. It holds a
+	// comma separated list of egress IPs on a MachineSet, which are spread
+	// across the egressIPs of its HostSubnets.
+	AnnotationEgressIPs = "appuio.ch/egress-ips"
+	// AnnotationEgressIPsManagedBy marks the egressIPs of a HostSubnet as
+	// managed. The value is the MachineSet they are assigned from.
+	AnnotationEgressIPsManagedBy = "appuio.ch/egress-ips-managed-by"
+)
+
+// parseEgressIPs splits a comma separated list of IPv4 addresses. The result
+// is normalized, sorted and free of duplicates.
+func parseEgressIPs(s string) ([]v1.HostSubnetEgressIP, error) {
+	seen := make(map[string]bool)
+	ips := make([]string, 0)
+	var invalid []string
+	for _, entry := range splitRe.Split(strings.TrimSpace(s), -1) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		ip := net.ParseIP(entry).To4()
+		if ip == nil {
+			invalid = append(invalid, fmt.Sprintf("%q", entry))
+			continue
+		}
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			ips = append(ips, ip.String())
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("invalid IPv4 addresses %s", strings.Join(invalid, ", "))
+	}
+
+	sort.Strings(ips)
+	out := make([]v1.HostSubnetEgressIP, len(ips))
+	for i := range ips {
+		out[i] = v1.HostSubnetEgressIP(ips[i])
+	}
+	return out, nil
+}
+
+// AssignEgressIPs spreads `ips` across `nodes`. Each node gets the same number
+// of IPs, give or take one. IPs stay on the node they are on in `current` as
+// far as the balance allows, so adding or removing a node only moves the IPs
+// to or from that node. The remaining IPs go to the nodes with the fewest IPs,
+// ties are broken by hashing IP and node name, so the result only depends on
+// the inputs. All `nodes` are in the result, if only with an empty list.
+func AssignEgressIPs(ips []v1.HostSubnetEgressIP, nodes []string, current map[string][]v1.HostSubnetEgressIP) map[string][]v1.HostSubnetEgressIP {
+	nodes = append([]string(nil), nodes...)
+	sort.Strings(nodes)
+	assignment := make(map[string][]v1.HostSubnetEgressIP, len(nodes))
+	for _, node := range nodes {
+		assignment[node] = []v1.HostSubnetEgressIP{}
+	}
+	if len(nodes) == 0 {
+		return assignment
+	}
+
+	wanted := make(map[v1.HostSubnetEgressIP]bool, len(ips))
+	for _, ip := range ips {
+		wanted[ip] = true
+	}
+	placed := make(map[v1.HostSubnetEgressIP]bool, len(ips))
+
+	// Every node gets `base` IPs, `extra` of them one more
+	base, extra := len(ips)/len(nodes), len(ips)%len(nodes)
+	hasExtra := make(map[string]bool)
+
+	// Keep the current IPs, starting with the nodes that have the most, so
+	// the extra slots go to nodes which can use them.
+	kept := make(map[string][]v1.HostSubnetEgressIP, len(nodes))
+	for _, node := range nodes {
+		for _, ip := range sortedIPs(current[node]) {
+			if wanted[ip] && !placed[ip] {
+				kept[node] = append(kept[node], ip)
+				placed[ip] = true
+			}
+		}
+	}
+	byKept := append([]string(nil), nodes...)
+	sort.SliceStable(byKept, func(i, j int) bool {
+		if len(kept[byKept[i]]) != len(kept[byKept[j]]) {
+			return len(kept[byKept[i]]) > len(kept[byKept[j]])
+		}
+		return byKept[i] < byKept[j]
+	})
+	for _, node := range byKept {
+		limit := base
+		if len(kept[node]) > base && extra > 0 {
+			limit++
+			extra--
+			hasExtra[node] = true
+		}
+		if len(kept[node]) > limit {
+			for _, ip := range kept[node][limit:] {
+				placed[ip] = false
+			}
+			kept[node] = kept[node][:limit]
+		}
+		assignment[node] = append(assignment[node], kept[node]...)
+	}
+
+	for _, ip := range ips {
+		if placed[ip] {
+			continue
+		}
+		best := ""
+		for _, node := range nodes {
+			n := len(assignment[node])
+			if n > base || n == base && (extra == 0 || hasExtra[node]) {
+				continue
+			}
+			if best == "" || n < len(assignment[best]) ||
+				n == len(assignment[best]) && ipScore(ip, node) > ipScore(ip, best) {
+				best = node
+			}
+		}
+		if len(assignment[best]) == base {
+			extra--
+			hasExtra[best] = true
+		}
+		assignment[best] = append(assignment[best], ip)
+		placed[ip] = true
+	}
+
+	for node := range assignment {
+		assignment[node] = sortedIPs(assignment[node])
+	}
+	return assignment
+}
+
+// AssignEgressIPsOnSubnets spreads `ips` across the nodes in `nodeIPs` like
+// AssignEgressIPs, but only onto nodes with an IP in the same subnet of length
+// `prefix` as the egress IP, as OpenShift SDN can only host egress IPs on the
+// primary subnet of a node. Nodes without IPs are assumed to be on every
+// subnet. IPs on a subnet without nodes are returned as unreachable. A
+// `prefix` of 0 disables the check.
+func AssignEgressIPsOnSubnets(
+	ips []v1.HostSubnetEgressIP,
+	nodeIPs map[string][]net.IP,
+	prefix int,
+	current map[string][]v1.HostSubnetEgressIP,
+) (assignment map[string][]v1.HostSubnetEgressIP, unreachable []v1.HostSubnetEgressIP) {
+	nodes := make([]string, 0, len(nodeIPs))
+	for node := range nodeIPs {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	if prefix == 0 {
+		return AssignEgressIPs(ips, nodes, current), nil
+	}
+
+	mask := net.CIDRMask(prefix, 32)
+	subnets := make([]string, 0)
+	bySubnet := make(map[string][]v1.HostSubnetEgressIP)
+	for _, ip := range sortedIPs(ips) {
+		subnet := net.ParseIP(string(ip)).Mask(mask).String()
+		if _, ok := bySubnet[subnet]; !ok {
+			subnets = append(subnets, subnet)
+		}
+		bySubnet[subnet] = append(bySubnet[subnet], ip)
+	}
+
+	assignment = make(map[string][]v1.HostSubnetEgressIP, len(nodes))
+	for _, node := range nodes {
+		assignment[node] = []v1.HostSubnetEgressIP{}
+	}
+	for _, subnet := range subnets {
+		members := make([]string, 0, len(nodes))
+		for _, node := range nodes {
+			if onSubnet(nodeIPs[node], mask, subnet) {
+				members = append(members, node)
+			}
+		}
+		if len(members) == 0 {
+			unreachable = append(unreachable, bySubnet[subnet]...)
+			continue
+		}
+		for node, assigned := range AssignEgressIPs(bySubnet[subnet], members, current) {
+			assignment[node] = append(assignment[node], assigned...)
+		}
+	}
+
+	for node := range assignment {
+		assignment[node] = sortedIPs(assignment[node])
+	}
+	return assignment, unreachable
+}
+
+// onSubnet returns true if one of `ips` is on `subnet` with `mask`, or if
+// `ips` is empty.
+func onSubnet(ips []net.IP, mask net.IPMask, subnet string) bool {
+	if len(ips) == 0 {
+		return true
+	}
+	for _, ip := range ips {
+		if ip.Mask(mask).String() == subnet {
+			return true
+		}
+	}
+	return false
+}
+
+// ipScore is the rendezvous hash of `ip` on `node`.
+func ipScore(ip v1.HostSubnetEgressIP, node string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(ip))
+	h.Write([]byte{0})
+	h.Write([]byte(node))
+	return h.Sum64()
+}
+
+func sortedIPs(ips []v1.HostSubnetEgressIP) []v1.HostSubnetEgressIP {
+	sorted := append([]v1.HostSubnetEgressIP{}, ips...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return sorted
+}
+
+func equalIPs(this, other []v1.HostSubnetEgressIP) bool {
+	this, other = sortedIPs(this), sortedIPs(other)
+	if len(this) != len(other) {
+		return false
+	}
+	for i := range this {
+		if this[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// invalidateAssignment marks the egress IP assignment of `machineSet` stale,
+// if it is not empty.
+func (c *Controller) invalidateAssignment(machineSet string) {
+	if machineSet != "" {
+		c.cidrs.MarkAssignmentStale(machineSet)
+	}
+}
+
+// egressIPMember returns true if the node of `m` takes part in the egress IP
+// distribution of its MachineSet. Deleted Machines are left out, so their IPs
+// move before the node goes away.
+func egressIPMember(layout Layout, m *v1beta1.Machine) bool {
+	return m.DeletionTimestamp == nil && !layout.Ignores(m) && layout.MachineSetOf(m) != ""
+}
+
+// applyEgressIPs sets the egressIPs of `hs` to the IPs assigned to it from
+// MachineSet `machineset`. If the HostSubnet got its egressIPs from a
+// MachineSet which no longer assigns them, they are cleared. Returns
+// OutcomeUpToDate if nothing needed to change.
+func applyEgressIPs(hs subnetObject, cidrs *CIDRMap, machineset string) ReconcileResult {
+	managedBy := hs.Annotations[AnnotationEgressIPsManagedBy]
+	desired, assigned := cidrs.AssignedIPs(machineset, hs.Name)
+	marker := &machineset
+	switch {
+	case assigned:
+		if managedBy == machineset && equalIPs(desired, hs.EgressIPs) {
+			return ReconcileResult{Outcome: OutcomeUpToDate, Reason: "egress ips up to date", MachineSet: machineset}
+		}
+	case managedBy == "" || managedBy == machineset && cidrs.HasIPs(machineset):
+		// Not managed, or not assigned yet
+		return ReconcileResult{Outcome: OutcomeUpToDate, Reason: "egress ips not managed", MachineSet: machineset}
+	default:
+		desired, marker = []v1.HostSubnetEgressIP{}, nil
+	}
+
+	klog.Infof("HostSubnet<%s>: Setting egressIPs to %v (was %v)", hs.Name, desired, hs.EgressIPs)
+	err := hs.send(objectPatch{
+		EgressIPs:   desired,
+		Annotations: map[string]*string{AnnotationEgressIPsManagedBy: marker},
+	})
+	if err != nil {
+		klog.Errorf("HostSubnet<%s>: updating egressIPs: %s", hs.Name, err)
+		hs.record(machineset, corev1.EventTypeWarning, ReasonUpdateFailed,
+			"Failed to set egressIPs to %v: %s", desired, err)
+		return ReconcileResult{
+			Outcome:    OutcomeError,
+			Reason:     "update hostsubnet egress ips",
+			MachineSet: machineset,
+			Requeue:    !apierrors.IsNotFound(err) && !apierrors.IsInvalid(err),
+			Err:        err,
+		}
+	}
+
+	if marker == nil {
+		hs.record(managedBy, corev1.EventTypeNormal, ReasonEgressIPsReleased,
+			"Removed egressIPs %v, no longer assigned from MachineSet %s", hs.EgressIPs, managedBy)
+		return ReconcileResult{Outcome: OutcomeReleased, Reason: "egress ips released", MachineSet: machineset}
+	}
+	hs.record(machineset, corev1.EventTypeNormal, ReasonEgressIPsUpdated,
+		"Set egressIPs to %v (was %v) from MachineSet %s", desired, hs.EgressIPs, machineset)
+	return ReconcileResult{Outcome: OutcomeUpdated, Reason: "egress ips updated", MachineSet: machineset}
+}
+
+// syncEgressIPs updates the egress IPs of `ms` in the CIDRMap from its
+// annotation and triggers a reconcilation of its HostSubnets if they changed.
+// OpenShift SDN can't mix egressCIDRs and egressIPs on the same node, so the
+// egress IPs of a MachineSet which also has egress CIDRs are ignored.
+func (c *Controller) syncEgressIPs(ms *v1beta1.MachineSet) {
+	layout := c.current().layout
+	ips := layout.EgressIPsOf(ms)
+	if ips != "" && layout.EgressCIDRsOf(ms) != "" {
+		klog.Errorf("MachineSet<%s>: ignoring annotation '%s', cannot be combined with '%s'",
+			ms.Name, layout.EgressIPsAnnotation, layout.EgressCIDRsAnnotation)
+		c.recorder.Eventf(ms, corev1.EventTypeWarning, ReasonInvalidAnnotation,
+			"Ignoring annotation %s, OpenShift SDN doesn't support egress IPs on nodes with egress CIDRs from annotation %s",
+			layout.EgressIPsAnnotation, layout.EgressCIDRsAnnotation)
+		ips = ""
+	}
+	if ips == "" {
+		if c.cidrs.HasIPs(ms.Name) {
+			c.cidrs.DeleteIPs(ms.Name)
+			c.triggerReconcile(ms.Name)
+		}
+		return
+	}
+	if c.cidrs.EqualIPs(ms.Name, ips) {
+		return
+	}
+	if c.networkType != NetworkTypeOpenShiftSDN {
+		klog.Warningf("MachineSet<%s>: ignoring annotation '%s', only supported with %s", ms.Name, layout.EgressIPsAnnotation, NetworkTypeOpenShiftSDN)
+		c.recorder.Eventf(ms, corev1.EventTypeWarning, ReasonInvalidAnnotation,
+			"Ignoring annotation %s, only supported with %s", layout.EgressIPsAnnotation, NetworkTypeOpenShiftSDN)
+		return
+	}
+
+	if err := c.cidrs.SetIPs(ms.Name, ips); err != nil {
+		klog.Errorf("MachineSet<%s>: invalid annotation '%s', keeping %v: %s", ms.Name, layout.EgressIPsAnnotation, c.cidrs.IPs(ms.Name), err)
+		c.recorder.Eventf(ms, corev1.EventTypeWarning, ReasonInvalidAnnotation,
+			"Keeping egress IPs %v, annotation %s is invalid: %s", c.cidrs.IPs(ms.Name), layout.EgressIPsAnnotation, err)
+		return
+	}
+	c.triggerReconcile(ms.Name)
+}
+
+// assignEgressIPs recomputes the egress IP assignment of `machineSet` from
+// its current members if it is stale, see CIDRMap.MarkAssignmentStale. If the
+// assignment changed, all HostSubnets of the MachineSet are reconciled. Must
+// only be called once the caches are synced, otherwise IPs are moved off nodes
+// missing from the caches.
+func (c *Controller) assignEgressIPs(machineSet string) {
+	c.assignMutex.Lock()
+	defer c.assignMutex.Unlock()
+	if !c.cidrs.ClaimStaleAssignment(machineSet) {
+		return
+	}
+
+	layout := c.current().layout
+	selector := labels.SelectorFromSet(labels.Set{layout.MachineSetLabel: machineSet})
+	machines, err := c.machines.List(selector)
+	if err != nil {
+		klog.Errorf("MachineSet<%s>: list machines: %s", machineSet, err)
+		c.cidrs.MarkAssignmentStale(machineSet)
+		return
+	}
+	nodes := make(map[string][]net.IP, len(machines))
+	for _, m := range machines {
+		if !egressIPMember(layout, m) {
+			continue
+		}
+		node, err := c.index.NodeForMachine(m)
+		if err != nil || node == "" {
+			continue
+		}
+		if hs, err := c.hostSubnets.Get(node); err == nil {
+			nodes[node] = nodeIPs(hs, m)
+		}
+	}
+
+	current, ok := c.cidrs.Assignment(machineSet)
+	if !ok {
+		// First assignment since the start, pick up what's on the HostSubnets
+		current = make(map[string][]v1.HostSubnetEgressIP, len(nodes))
+		for node := range nodes {
+			if hs, err := c.hostSubnets.Get(node); err == nil && hs.Annotations[AnnotationEgressIPsManagedBy] == machineSet {
+				current[node] = hs.EgressIPs
+			}
+		}
+	}
+
+	assignment, unreachable := AssignEgressIPsOnSubnets(c.cidrs.IPs(machineSet), nodes, layout.NodeSubnetPrefix, current)
+	if c.cidrs.SetAssignment(machineSet, assignment) {
+		klog.Infof("MachineSet<%s>: egress IPs assigned: %v", machineSet, assignment)
+		if len(unreachable) > 0 {
+			klog.Warningf("MachineSet<%s>: egress IPs %v not on the /%d subnet of any node", machineSet, unreachable, layout.NodeSubnetPrefix)
+			if ms, err := c.machineSets.Get(machineSet); err == nil {
+				c.recorder.Eventf(ms, corev1.EventTypeWarning, ReasonUnreachableCIDR,
+					"Egress IPs %v are not on the /%d subnet of any node of the MachineSet", unreachable, layout.NodeSubnetPrefix)
+			}
+		}
+		c.triggerReconcile(machineSet)
+	}
+}
@@ -0,0 +1,240 @@
+package controller_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	"github.com/matryer/is"
+	v1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCIDRMapSetIPs(t *testing.T) {
+	is := is.New(t)
+	cm := controller.NewCIDRMap()
+	cm.SetReserved(controller.ParseReservedNetworks("service network", false, "172.30.0.0/16"))
+
+	is.NoErr(cm.SetIPs("a", "192.0.2.20, 192.0.2.10,192.0.2.10"))
+	is.Equal(cm.IPs("a"), []v1.HostSubnetEgressIP{"192.0.2.10", "192.0.2.20"})
+	is.True(cm.EqualIPs("a", "192.0.2.20,192.0.2.10"))
+	is.True(!cm.EqualIPs("a", "192.0.2.10"))
+
+	is.True(cm.SetIPs("a", "192.0.2.300") != nil) // invalid
+	is.True(cm.SetIPs("a", "2001:db8::1") != nil) // not IPv4
+	is.True(cm.SetIPs("a", "172.30.0.10") != nil) // reserved
+	is.True(cm.SetIPs("b", "192.0.2.20") != nil)  // listed by a
+	is.Equal(cm.IPs("a"), []v1.HostSubnetEgressIP{"192.0.2.10", "192.0.2.20"})
+
+	cm.DeleteIPs("a")
+	is.True(!cm.HasIPs("a"))
+	is.NoErr(cm.SetIPs("b", "192.0.2.20"))
+
+	// egress CIDRs and egress IPs must not overlap
+	is.NoErr(cm.Set("c", "198.51.100.0/24"))
+	is.True(cm.SetIPs("b", "198.51.100.10") != nil)
+	is.Equal(len(cm.Overlapping("d", "192.0.2.0/24")), 1) // contains IP of b
+}
+
+func TestCIDRMapStaleAssignment(t *testing.T) {
+	is := is.New(t)
+	cm := controller.NewCIDRMap()
+	cm.MarkAssignmentStale("a")
+	is.True(!cm.ClaimStaleAssignment("a")) // no egress IPs
+
+	is.NoErr(cm.SetIPs("a", "192.0.2.10"))
+	is.True(cm.ClaimStaleAssignment("a"))
+	is.True(cm.ClaimStaleAssignment("a")) // still unassigned
+	cm.SetAssignment("a", map[string][]v1.HostSubnetEgressIP{"node-a": {"192.0.2.10"}})
+	is.True(!cm.ClaimStaleAssignment("a"))
+
+	cm.MarkAssignmentStale("a")
+	is.True(cm.ClaimStaleAssignment("a"))
+	is.True(!cm.ClaimStaleAssignment("a")) // claimed once
+
+	is.NoErr(cm.SetIPs("a", "192.0.2.10,192.0.2.11"))
+	is.True(cm.ClaimStaleAssignment("a"))
+}
+
+func TestAssignEgressIPs(t *testing.T) {
+	is := is.New(t)
+	ips := mockEgressIPs(7)
+	nodes := []string{"node-a", "node-b", "node-c"}
+
+	assignment := controller.AssignEgressIPs(ips, nodes, nil)
+	assertBalanced(t, assignment, ips)
+
+	// Deterministic and stable
+	is.Equal(controller.AssignEgressIPs(ips, []string{"node-c", "node-a", "node-b"}, nil), assignment)
+	is.Equal(controller.AssignEgressIPs(ips, nodes, assignment), assignment)
+
+	// Removing a node only moves its own IPs
+	removed := controller.AssignEgressIPs(ips, nodes[:2], assignment)
+	assertBalanced(t, removed, ips)
+	for _, node := range nodes[:2] {
+		is.True(containsAll(removed[node], assignment[node]))
+	}
+
+	// Adding a node only moves IPs onto it
+	added := controller.AssignEgressIPs(ips, append(nodes, "node-d"), assignment)
+	assertBalanced(t, added, ips)
+	moved := 0
+	for _, node := range nodes {
+		is.True(containsAll(assignment[node], added[node]))
+		moved += len(assignment[node]) - len(added[node])
+	}
+	is.Equal(moved, len(added["node-d"]))
+
+	// Removed IPs are dropped, new ones fill up the least loaded nodes
+	changed := controller.AssignEgressIPs(append(ips[1:], "192.0.2.100"), nodes, assignment)
+	assertBalanced(t, changed, append(ips[1:], "192.0.2.100"))
+
+	// More nodes than IPs
+	sparse := controller.AssignEgressIPs(ips[:2], append(nodes, "node-d"), nil)
+	assertBalanced(t, sparse, ips[:2])
+	is.Equal(len(sparse), 4)
+}
+
+func TestAssignEgressIPsOnSubnets(t *testing.T) {
+	is := is.New(t)
+	ips := []v1.HostSubnetEgressIP{"192.0.2.10", "192.0.2.11", "198.51.100.10", "203.0.113.10"}
+	nodes := map[string][]net.IP{
+		"node-a":  {net.ParseIP("192.0.2.1")},
+		"node-b":  {net.ParseIP("192.0.2.2")},
+		"node-c":  {net.ParseIP("198.51.100.1")},
+		"unknown": nil,
+	}
+
+	assignment, unreachable := controller.AssignEgressIPsOnSubnets(ips, nodes, 24, nil)
+	is.Equal(unreachable, []v1.HostSubnetEgressIP(nil)) // unknown takes 203.0.113.10
+	is.Equal(assignment["node-c"], []v1.HostSubnetEgressIP{"198.51.100.10"})
+	is.Equal(len(assignment["node-a"])+len(assignment["node-b"])+len(assignment["unknown"]), 3)
+	is.True(!containsAll(assignment["node-a"], []v1.HostSubnetEgressIP{"198.51.100.10"}))
+
+	delete(nodes, "unknown")
+	assignment, unreachable = controller.AssignEgressIPsOnSubnets(ips, nodes, 24, nil)
+	is.Equal(unreachable, []v1.HostSubnetEgressIP{"203.0.113.10"})
+	is.Equal(assignment["node-c"], []v1.HostSubnetEgressIP{"198.51.100.10"})
+	assertBalanced(t, map[string][]v1.HostSubnetEgressIP{
+		"node-a": assignment["node-a"],
+		"node-b": assignment["node-b"],
+	}, ips[:2])
+
+	// without a prefix all nodes are eligible
+	assignment, unreachable = controller.AssignEgressIPsOnSubnets(ips, nodes, 0, nil)
+	is.Equal(len(unreachable), 0)
+	assertBalanced(t, assignment, ips)
+}
+
+func TestReconcileSubnetEgressIPs(t *testing.T) {
+	is := is.New(t)
+	hs := mockHostSubnet("node123")
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.SetIPs("some", "192.0.2.10,192.0.2.11"))
+	cm.SetAssignment("some", controller.AssignEgressIPs(cm.IPs("some"), []string{hs.Name}, nil))
+	getMachine, _ := mockGetMachine(t, "some", hs.Name)
+	patch, patches := capturePatches()
+	recordEvent, events := mockRecorder()
+
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, cm, getMachine, patch, recordEvent)
+	is.Equal(res.Outcome, controller.OutcomeUpdated)
+	is.Equal(*events, []string{"some Normal EgressIPsUpdated"})
+	is.Equal(len(*patches), 1)
+	patched := new(v1.HostSubnet)
+	is.NoErr(json.Unmarshal([]byte((*patches)[0]), patched))
+	is.Equal(patched.EgressIPs, []v1.HostSubnetEgressIP{"192.0.2.10", "192.0.2.11"})
+	is.Equal(patched.EgressCIDRs, nil) // left alone
+	is.Equal(patched.Annotations[controller.AnnotationEgressIPsManagedBy], "some")
+
+	// Up to date
+	hs.EgressIPs = patched.EgressIPs
+	hs.SetAnnotations(patched.Annotations)
+	res = controller.ReconcileSubnet(controller.DefaultLayout(), hs, cm, getMachine, patch, recordEvent)
+	is.Equal(res.Outcome, controller.OutcomeSkipped) // no egress CIDRs
+	is.Equal(len(*patches), 1)
+
+	// Released once the annotation is gone
+	cm.DeleteIPs("some")
+	res = controller.ReconcileSubnet(controller.DefaultLayout(), hs, cm, getMachine, patch, recordEvent)
+	is.Equal(res.Outcome, controller.OutcomeReleased)
+	is.Equal(len(*patches), 2)
+	is.Equal((*patches)[1], `{"egressIPs":[],"metadata":{"annotations":{"appuio.ch/egress-ips-managed-by":null}}}`)
+}
+
+func TestPlanEgressIPs(t *testing.T) {
+	is := is.New(t)
+	idx, machines, _ := mockIndex()
+	hostSubnets := make([]*v1.HostSubnet, 0)
+	for _, name := range []string{"a", "b"} {
+		m := mockMachine("m-"+name, "some")
+		m.Status.NodeRef = &corev1.ObjectReference{Name: "node-" + name}
+		is.NoErr(machines.Add(m))
+		hostSubnets = append(hostSubnets, mockHostSubnet("node-"+name))
+	}
+	// node-a already has one of the IPs
+	hostSubnets[0].EgressIPs = []v1.HostSubnetEgressIP{"192.0.2.11"}
+	hostSubnets[0].SetAnnotations(map[string]string{controller.AnnotationEgressIPsManagedBy: "some"})
+
+	ms := mockMachineSet("some", nil, "")
+	ms.SetAnnotations(map[string]string{controller.AnnotationEgressIPs: "192.0.2.10,192.0.2.11"})
+	cidrs, errs := controller.BuildCIDRMap(mockOptions(controller.ReleaseKeep), nil, []*v1beta1.MachineSet{ms}, nil, nil)
+	is.Equal(len(errs), 0)
+
+	plan := controller.Plan(controller.DefaultLayout(), hostSubnets, cidrs, idx.MachineForNode)
+	is.Equal(len(plan), 2)
+	is.True(!plan[0].Pending)
+	is.Equal(plan[0].DesiredIPs, []v1.HostSubnetEgressIP{"192.0.2.11"})
+	is.True(plan[1].Pending)
+	is.Equal(plan[1].Outcome, controller.OutcomeUpdated)
+	is.Equal(plan[1].DesiredIPs, []v1.HostSubnetEgressIP{"192.0.2.10"})
+}
+
+func mockEgressIPs(n int) []v1.HostSubnetEgressIP {
+	ips := make([]v1.HostSubnetEgressIP, n)
+	for i := range ips {
+		ips[i] = v1.HostSubnetEgressIP(fmt.Sprintf("192.0.2.%d", 10+i))
+	}
+	return ips
+}
+
+// assertBalanced checks that each of `ips` is assigned exactly once and that
+// the number of IPs per node differs by one at most.
+func assertBalanced(t *testing.T, assignment map[string][]v1.HostSubnetEgressIP, ips []v1.HostSubnetEgressIP) {
+	t.Helper()
+	is := is.New(t)
+	seen := make(map[v1.HostSubnetEgressIP]int)
+	min, max := len(ips), 0
+	for _, assigned := range assignment {
+		for _, ip := range assigned {
+			seen[ip]++
+		}
+		if len(assigned) < min {
+			min = len(assigned)
+		}
+		if len(assigned) > max {
+			max = len(assigned)
+		}
+	}
+	is.Equal(len(seen), len(ips))
+	for _, ip := range ips {
+		is.Equal(seen[ip], 1)
+	}
+	is.True(max-min <= 1)
+}
+
+// containsAll returns true if all `subset` IPs are in `ips`.
+func containsAll(ips, subset []v1.HostSubnetEgressIP) bool {
+	for _, s := range subset {
+		found := false
+		for _, ip := range ips {
+			found = found || ip == s
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
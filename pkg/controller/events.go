@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"fmt"
+
+	networkv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	EventComponent = "machineset-egress-cidr-operator"
+
+	ReasonUpdated           = "EgressCIDRsUpdated"
+	ReasonUpdateFailed      = "EgressCIDRsUpdateFailed"
+	ReasonReleased          = "EgressCIDRsReleased"
+	ReasonRestoreFailed     = "EgressCIDRsRestoreFailed"
+	ReasonInvalidAnnotation = "InvalidAnnotation"
+	ReasonOverlap           = "EgressCIDRsOverlap"
+	ReasonReservedNetwork   = "ReservedNetworkCollision"
+	ReasonCIDRsInUse        = "EgressCIDRsInUse"
+	ReasonUnreachableCIDR   = "EgressCIDRUnreachable"
+	ReasonUnresolvedNode    = "UnresolvedNode"
+	ReasonNoMachineSet      = "NoMachineSet"
+	ReasonEgressIPsUpdated  = "EgressIPsUpdated"
+	ReasonEgressIPsReleased = "EgressIPsReleased"
+
+	ReasonEgressIPAllocated        = "EgressIPAllocated"
+	ReasonEgressIPAllocationFailed = "EgressIPAllocationFailed"
+	ReasonEgressIPReleased         = "EgressIPReleased"
+)
+
+// Recorder records an event on the HostSubnet `hs` and, if `machineSet` is
+// not empty, the same event on the MachineSet with that name.
+type Recorder func(hs *networkv1.HostSubnet, machineSet, eventtype, reason, messageFmt string, args ...interface{})
+
+func (c *Controller) createRecorder() {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(corev1.AddToScheme(scheme))
+	utilruntime.Must(networkv1.Install(scheme))
+	utilruntime.Must(v1beta1.AddToScheme(scheme))
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(klog.V(4).Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: c.kubeClient.CoreV1().Events(""),
+	})
+
+	c.eventBroadcaster = broadcaster
+	c.recorder = broadcaster.NewRecorder(scheme, corev1.EventSource{Component: EventComponent})
+}
+
+// recordEvent satisfies Recorder.
+func (c *Controller) recordEvent(hs *networkv1.HostSubnet, machineSet, eventtype, reason, messageFmt string, args ...interface{}) {
+	c.recordObjectEvent(hs, "HostSubnet "+hs.Name, machineSet, eventtype, reason, messageFmt, args...)
+}
+
+// recordObjectEvent records an event on `obj` and, if `machineSet` is not
+// empty, the same event prefixed with `subject` on the MachineSet with that
+// name.
+func (c *Controller) recordObjectEvent(obj runtime.Object, subject, machineSet, eventtype, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	if c.current().dryRun {
+		message = "Dry run: " + message
+	}
+	c.recorder.Event(obj, eventtype, reason, message)
+	if machineSet == "" {
+		return
+	}
+
+	ms, err := c.machineSets.Get(machineSet)
+	if err != nil {
+		klog.V(4).Infof("MachineSet<%s>: not recording event: %s", machineSet, err)
+		return
+	}
+	c.recorder.Eventf(ms, eventtype, reason, "%s: %s", subject, message)
+}
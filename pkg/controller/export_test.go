@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"fmt"
+
+	v1 "github.com/openshift/api/network/v1"
+	networkListers "github.com/openshift/client-go/network/listers/network/v1"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	machineListers "github.com/openshift/machine-api-operator/pkg/generated/listers/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// NewTestController returns a Controller on OpenShift SDN for tests of the
+// event handlers and metrics. Its listers read the given `objects`, which
+// may be Machines, Nodes, HostSubnets and NetNamespaces, and events are
+// recorded to `recorder`. Nothing is started and no API is called.
+func NewTestController(opts Options, recorder record.EventRecorder, objects ...runtime.Object) *Controller {
+	indexers := func(extra cache.Indexers) cache.Indexers {
+		all := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+		for name, fn := range extra {
+			all[name] = fn
+		}
+		return all
+	}
+	machines := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers(MachineIndexers))
+	machineSets := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers(nil))
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers(NodeIndexers))
+	hostSubnets := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers(nil))
+	netNamespaces := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers(nil))
+	for _, obj := range objects {
+		var err error
+		switch obj.(type) {
+		case *v1beta1.Machine:
+			err = machines.Add(obj)
+		case *corev1.Node:
+			err = nodes.Add(obj)
+		case *v1.HostSubnet:
+			err = hostSubnets.Add(obj)
+		case *v1.NetNamespace:
+			err = netNamespaces.Add(obj)
+		default:
+			err = fmt.Errorf("unexpected object %T", obj)
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	c := &Controller{
+		cidrs:       NewCIDRMap(),
+		queue:       workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		networkType: NetworkTypeOpenShiftSDN,
+		settings: settings{
+			layout:         opts.Layout,
+			defaultRelease: opts.DefaultReleasePolicy,
+			strictOverlaps: opts.StrictOverlaps,
+		},
+		policyKeys:    make(map[string]string),
+		index:         NewMachineNodeIndex(machines, nodes),
+		machines:      machineListers.NewMachineLister(machines).Machines(opts.Layout.MachineNamespace),
+		machineSets:   machineListers.NewMachineSetLister(machineSets).MachineSets(opts.Layout.MachineNamespace),
+		hostSubnets:   networkListers.NewHostSubnetLister(hostSubnets),
+		netNamespaces: networkListers.NewNetNamespaceLister(netNamespaces),
+		recorder:      recorder,
+	}
+	c.target = sdnTarget{c}
+	return c
+}
+
+// CIDRs returns the CIDRMap of `c`.
+func (c *Controller) CIDRs() *CIDRMap {
+	return c.cidrs
+}
@@ -0,0 +1,250 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	configclient "github.com/openshift/client-go/config/clientset/versioned"
+	"github.com/openshift/machine-api-operator/pkg/generated/clientset/versioned"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// watchErrorWindow is how long a watch error marks an informer as
+	// failing. The reflector retries at least every 30 seconds, so a
+	// persistent failure keeps reporting errors within the window.
+	watchErrorWindow = time.Minute
+	// apiCheckInterval is the interval of the API server check.
+	apiCheckInterval = 30 * time.Second
+	// apiCheckTimeout is how long the API server may be unreachable before
+	// /healthz fails.
+	apiCheckTimeout = 2 * time.Minute
+)
+
+// health tracks the state reported by the health endpoints.
+type health struct {
+	mutex sync.Mutex
+
+	informers   map[string]cache.SharedIndexInformer
+	watchErrors map[string]watchError
+
+	lastList    time.Time
+	lastListErr error
+	// clusterNetworkType is the network type last reported by the cluster,
+	// empty if unknown.
+	clusterNetworkType NetworkType
+
+	// running is true while Run is in progress, synced once the initial
+	// sync completed.
+	running bool
+	synced  bool
+	// lastProgress is the last time a worker took or finished an item.
+	lastProgress time.Time
+}
+
+type watchError struct {
+	err error
+	at  time.Time
+}
+
+func newHealth() *health {
+	return &health{
+		informers:   make(map[string]cache.SharedIndexInformer),
+		watchErrors: make(map[string]watchError),
+		lastList:    time.Now(),
+	}
+}
+
+// watchInformer registers a watch error handler on `informer`. Must be called
+// before the informer is started.
+func (h *health) watchInformer(name string, informer cache.SharedIndexInformer) {
+	h.informers[name] = informer
+	err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		cache.DefaultWatchErrorHandler(r, err)
+		if errors.Is(err, io.EOF) || apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+			// Watch closed normally
+			return
+		}
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		h.watchErrors[name] = watchError{err: err, at: time.Now()}
+	})
+	if err != nil {
+		klog.Errorf("Informer<%s>: set watch error handler: %s", name, err)
+	}
+}
+
+func (h *health) setRunning(running, synced bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.running, h.synced = running, synced
+	h.lastProgress = time.Now()
+}
+
+func (h *health) progress() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastProgress = time.Now()
+}
+
+// RunHealthChecks lists MachineSets every 30 seconds until `ctx` is done to
+// check the connection to the API server, and reads the network type of the
+// cluster. Runs on standbys as well.
+func (c *Controller) RunHealthChecks(ctx context.Context) {
+	clientset, err := versioned.NewForConfig(c.config)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	machineSets := clientset.MachineV1beta1().MachineSets(c.current().layout.MachineNamespace)
+	configClient, err := configclient.NewForConfig(c.config)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, apiCheckInterval/2)
+		defer cancel()
+		_, err := machineSets.List(ctx, metav1.ListOptions{Limit: 1})
+		// A network migration needs a restart to pick the new type up
+		networkType, networkErr := reportedNetworkType(ctx, configClient)
+
+		c.health.mutex.Lock()
+		defer c.health.mutex.Unlock()
+		c.health.lastListErr = err
+		if err == nil {
+			c.health.lastList = time.Now()
+		} else {
+			klog.Errorf("Health: list machinesets: %s", err)
+		}
+		if networkErr == nil || apierrors.IsNotFound(networkErr) {
+			c.health.clusterNetworkType = networkType
+		} else {
+			klog.Errorf("Health: get network config: %s", networkErr)
+		}
+	}, apiCheckInterval)
+}
+
+// HealthHandler serves the following endpoints:
+//
+// /healthz fails if the API server couldn't be reached for two minutes, an
+// informer failed to watch within the last minute or the cluster reports a
+// network type other than the one in use.
+//
+// /readyz fails while Run waits for the initial sync. Standbys are ready.
+//
+// /livez fails if items wait in the work queue but no worker made progress
+// within the stall timeout.
+func (c *Controller) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		writeChecks(w, c.healthChecks())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		writeChecks(w, c.readyChecks())
+	})
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, _ *http.Request) {
+		writeChecks(w, c.liveChecks())
+	})
+	return mux
+}
+
+// check is the result of a single health check. `err` is nil if it passed,
+// `info` is shown next to passed checks.
+type check struct {
+	name string
+	info string
+	err  error
+}
+
+func (c *Controller) healthChecks() []check {
+	h := c.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	checks := make([]check, 0, len(h.informers)+2)
+	api := check{name: "api"}
+	if since := time.Since(h.lastList); since > apiCheckTimeout {
+		api.err = fmt.Errorf("last successful list %s ago: %v", since.Round(time.Second), h.lastListErr)
+	}
+	checks = append(checks, api)
+
+	network := check{name: "network-type", info: string(c.networkType)}
+	if h.clusterNetworkType != "" && h.clusterNetworkType != c.networkType {
+		network.err = fmt.Errorf("running for %s, but the cluster reports %s, restart required", c.networkType, h.clusterNetworkType)
+	}
+	checks = append(checks, network)
+
+	for name := range h.informers {
+		informer := check{name: "informer-" + name}
+		if e, ok := h.watchErrors[name]; ok && time.Since(e.at) < watchErrorWindow {
+			informer.err = fmt.Errorf("watch failed %s ago: %s", time.Since(e.at).Round(time.Second), e.err)
+		}
+		checks = append(checks, informer)
+	}
+	sortChecks(checks)
+	return checks
+}
+
+func (c *Controller) readyChecks() []check {
+	h := c.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sync := check{name: "initial-sync"}
+	if h.running && !h.synced {
+		sync.err = errors.New("waiting for caches to sync")
+	}
+	return []check{sync}
+}
+
+func (c *Controller) liveChecks() []check {
+	h := c.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	queue := check{name: "queue"}
+	if h.running && h.synced {
+		since := time.Since(h.lastProgress)
+		if n := c.queue.Len(); n > 0 && since > c.stallTimeout {
+			queue.err = fmt.Errorf("%d items waiting, no progress for %s", n, since.Round(time.Second))
+		}
+	}
+	return []check{queue}
+}
+
+func sortChecks(checks []check) {
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].name < checks[j].name
+	})
+}
+
+// writeChecks writes one line per check and fails if any check failed.
+func writeChecks(w http.ResponseWriter, checks []check) {
+	status := http.StatusOK
+	for _, c := range checks {
+		if c.err != nil {
+			status = http.StatusInternalServerError
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	for _, c := range checks {
+		if c.err != nil {
+			fmt.Fprintf(w, "[-]%s failed: %s\n", c.name, c.err)
+		} else if c.info != "" {
+			fmt.Fprintf(w, "[+]%s ok: %s\n", c.name, c.info)
+		} else {
+			fmt.Fprintf(w, "[+]%s ok\n", c.name)
+		}
+	}
+}
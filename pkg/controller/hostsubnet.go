@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	v1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// HostSubnetPatcher has the signature of HostSubnetInterface.Patch.
+type HostSubnetPatcher func(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*v1.HostSubnet, error)
+
+func (f HostSubnetPatcher) untyped() objectPatcher {
+	return func(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions) error {
+		_, err := f(ctx, name, pt, data, opts)
+		return err
+	}
+}
+
+// subnetObject adapts a HostSubnet to egressObject.
+type subnetObject struct {
+	*v1.HostSubnet
+	patchHostSubnet HostSubnetPatcher
+	recordEvent     Recorder
+}
+
+func (o subnetObject) kind() string { return "HostSubnet" }
+
+// change sets the egressCIDRs to `desired`. If the layout has a
+// NodeSubnetPrefix, CIDRs outside of the node's subnet are skipped.
+func (o subnetObject) change(layout Layout, machine *v1beta1.Machine, desired []v1.HostSubnetEgressCIDR) egressChange {
+	if layout.NodeSubnetPrefix > 0 && len(nodeIPs(o.HostSubnet, machine)) == 0 {
+		klog.Warningf("HostSubnet<%s>: no node IP, not checking reachability", o.Name)
+	}
+	desired, unreachable := subnetEgressCIDRs(layout, o.HostSubnet, machine, desired)
+	if desired == nil {
+		// A null value would remove the field instead of clearing it
+		desired = []v1.HostSubnetEgressCIDR{}
+	}
+
+	change := egressChange{
+		upToDate: equalCIDRs(desired, o.EgressCIDRs),
+		patch:    objectPatch{EgressCIDRs: desired},
+		what:     fmt.Sprintf("egressCIDRs to %v (was %v)", desired, o.EgressCIDRs),
+		done:     fmt.Sprintf("Set egressCIDRs to %v (was %v)", desired, o.EgressCIDRs),
+	}
+	if len(unreachable) > 0 {
+		klog.Warningf("HostSubnet<%s>: skipping %v, not on the /%d subnet of the node", o.Name, unreachable, layout.NodeSubnetPrefix)
+		change.note = fmt.Sprintf(", skipped unreachable %v", unreachable)
+		change.warnings = []string{fmt.Sprintf("Skipped egressCIDRs %v, not on the /%d subnet of the node", unreachable, layout.NodeSubnetPrefix)}
+	}
+	return change
+}
+
+// subnetEgressCIDRs splits the `desired` egressCIDRs of `hs` into those it
+// gets and those skipped, because they are outside of the NodeSubnetPrefix
+// subnet of the node. Without a NodeSubnetPrefix or a node IP nothing is
+// skipped. `machine` may be nil.
+func subnetEgressCIDRs(layout Layout, hs *v1.HostSubnet, machine *v1beta1.Machine, desired []v1.HostSubnetEgressCIDR) (applied, unreachable []v1.HostSubnetEgressCIDR) {
+	if layout.NodeSubnetPrefix > 0 {
+		if ips := nodeIPs(hs, machine); len(ips) > 0 {
+			return reachableCIDRs(desired, ips, layout.NodeSubnetPrefix)
+		}
+	}
+	return desired, nil
+}
+
+func (o subnetObject) reconcileExtra(cidrs *CIDRMap, machineset string) ReconcileResult {
+	return applyEgressIPs(o, cidrs, machineset)
+}
+
+func (o subnetObject) snapshot() Snapshot {
+	return Snapshot{EgressCIDRs: append([]v1.HostSubnetEgressCIDR{}, o.EgressCIDRs...)}
+}
+
+func (o subnetObject) state() string {
+	return fmt.Sprintf("egressCIDRs %v", o.EgressCIDRs)
+}
+
+func (o subnetObject) clear(patch *objectPatch) string {
+	patch.EgressCIDRs = []v1.HostSubnetEgressCIDR{}
+	return fmt.Sprintf("cleared egressCIDRs (were %v)", o.EgressCIDRs)
+}
+
+func (o subnetObject) restore(s Snapshot, patch *objectPatch) (string, error) {
+	if s.EgressAssignable != nil {
+		return "", errors.New("snapshot was taken from a Node")
+	}
+	patch.EgressCIDRs = s.EgressCIDRs
+	if patch.EgressCIDRs == nil {
+		patch.EgressCIDRs = []v1.HostSubnetEgressCIDR{}
+	}
+	return fmt.Sprintf("restored egressCIDRs %v from %s (were %v)", patch.EgressCIDRs, formatTakenAt(s), o.EgressCIDRs), nil
+}
+
+func (o subnetObject) send(patch objectPatch) error {
+	return applyPatch(context.Background(), o.patchHostSubnet.untyped(), o.Name, patch)
+}
+
+func (o subnetObject) record(machineSet, eventtype, reason, messageFmt string, args ...interface{}) {
+	o.recordEvent(o.HostSubnet, machineSet, eventtype, reason, messageFmt, args...)
+}
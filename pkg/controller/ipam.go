@@ -0,0 +1,531 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "github.com/openshift/api/network/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+// allocationsRetryInterval is the interval in which loading the allocations
+// is retried.
+const allocationsRetryInterval = 10 * time.Second
+
+// createAllocator sets up the Namespace informer of the egress IP allocator,
+// which persists its allocations in ConfigMap `store`. Needs the NetNamespace
+// informer of the OpenShiftSDN target.
+func (c *Controller) createAllocator(store types.NamespacedName) {
+	namespaceInformer := c.kubeInformerFactory.Core().V1().Namespaces()
+	namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ns := obj.(*corev1.Namespace)
+			if ns.Annotations[AnnotationEgressIPRequest] != "" {
+				c.enqueueNamespace(ns.Name)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNs := oldObj.(*corev1.Namespace)
+			ns := newObj.(*corev1.Namespace)
+			if oldNs.Annotations[AnnotationEgressIPRequest] != ns.Annotations[AnnotationEgressIPRequest] ||
+				oldNs.Annotations[AnnotationEgressIPAllocated] != ns.Annotations[AnnotationEgressIPAllocated] ||
+				(oldNs.DeletionTimestamp == nil) != (ns.DeletionTimestamp == nil) {
+				c.enqueueNamespace(ns.Name)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			// The IP is released right away, but not allocated again while
+			// the NetNamespace still has it
+			if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+				c.enqueueNamespace(key)
+			}
+		},
+	})
+	c.netNamespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.enqueueNamespace(obj.(*v1.NetNamespace).Name)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNetns := oldObj.(*v1.NetNamespace)
+			netns := newObj.(*v1.NetNamespace)
+			if !equalNetNamespaceIPs(oldNetns.EgressIPs, netns.EgressIPs) {
+				c.enqueueNamespace(netns.Name)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+				c.enqueueNamespace(key)
+			}
+		},
+	})
+
+	c.ipamQueue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "namespaces")
+	c.allocationStore = store
+	c.namespaceInformer = namespaceInformer
+	c.health.watchInformer("namespaces", namespaceInformer.Informer())
+}
+
+// enqueueNamespace schedules an allocation check of the given namespace.
+func (c *Controller) enqueueNamespace(name string) {
+	if c.ipamQueue == nil {
+		return
+	}
+	c.ipamQueue.Add(name)
+}
+
+// enqueueAllocations schedules an allocation check of all namespaces which
+// requested or were allocated an egress IP from `machineSet`.
+func (c *Controller) enqueueAllocations(machineSet string) {
+	if c.ipamQueue == nil {
+		return
+	}
+
+	c.allocationMutex.Lock()
+	for ns, alloc := range c.allocations {
+		if alloc.MachineSet == machineSet {
+			c.ipamQueue.Add(ns)
+		}
+	}
+	c.allocationMutex.Unlock()
+
+	namespaces, err := c.namespaceInformer.Lister().List(labels.Everything())
+	if err != nil {
+		klog.Errorf("list namespaces: %s", err)
+		return
+	}
+	for _, ns := range namespaces {
+		if ns.Annotations[AnnotationEgressIPRequest] == machineSet {
+			c.ipamQueue.Add(ns.Name)
+		}
+	}
+}
+
+// startAllocator loads the allocations and waits for the allocator informers
+// to sync. All allocated namespaces are enqueued, so those deleted in the
+// meantime are released. Returns false if `ctx` is done first.
+func (c *Controller) startAllocator(ctx context.Context) bool {
+	if !c.loadAllocations(ctx) {
+		return false
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), c.namespaceInformer.Informer().HasSynced) {
+		return false
+	}
+
+	c.allocationMutex.Lock()
+	defer c.allocationMutex.Unlock()
+	for ns := range c.allocations {
+		c.ipamQueue.Add(ns)
+	}
+	return true
+}
+
+// loadAllocations reads the allocations from the ConfigMap, retrying until
+// it succeeds or `ctx` is done. A missing ConfigMap means no allocations.
+func (c *Controller) loadAllocations(ctx context.Context) bool {
+	store := c.allocationStore
+	err := wait.PollImmediateUntil(allocationsRetryInterval, func() (bool, error) {
+		cm, err := c.kubeClient.CoreV1().ConfigMaps(store.Namespace).Get(ctx, store.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			klog.Infof("ConfigMap<%s>: not found, no egress IPs allocated", store)
+			c.setAllocations(Allocations{})
+			return true, nil
+		}
+		if err != nil {
+			klog.Errorf("ConfigMap<%s>: %s", store, err)
+			return false, nil
+		}
+
+		allocations, errs := DecodeAllocations(cm.Data)
+		for _, err := range errs {
+			klog.Errorf("ConfigMap<%s>: ignoring %s", store, err)
+		}
+		klog.Infof("ConfigMap<%s>: %d egress IPs allocated", store, len(allocations))
+		c.setAllocations(allocations)
+		return true, nil
+	}, ctx.Done())
+	return err == nil
+}
+
+func (c *Controller) setAllocations(allocations Allocations) {
+	c.allocationMutex.Lock()
+	defer c.allocationMutex.Unlock()
+	c.allocations = allocations
+}
+
+// allocation returns the allocation of namespace `name`, and false if there
+// is none.
+func (c *Controller) allocation(name string) (Allocation, bool) {
+	c.allocationMutex.Lock()
+	defer c.allocationMutex.Unlock()
+	alloc, ok := c.allocations[name]
+	return alloc, ok
+}
+
+func (c *Controller) runIPAMWorker(ctx context.Context) {
+	for c.processNextNamespace(ctx) {
+	}
+}
+
+func (c *Controller) processNextNamespace(ctx context.Context) bool {
+	key, quit := c.ipamQueue.Get()
+	if quit {
+		return false
+	}
+	defer c.ipamQueue.Done(key)
+	if c.ipamQueue.ShuttingDown() {
+		return false
+	}
+
+	name := key.(string)
+	if err := c.syncNamespace(ctx, name); err != nil {
+		klog.Errorf("Namespace<%s>: requeue after %d retries: %s",
+			name, c.ipamQueue.NumRequeues(key), err)
+		c.ipamQueue.AddRateLimited(key)
+		return true
+	}
+
+	c.ipamQueue.Forget(key)
+	return true
+}
+
+// syncNamespace allocates an egress IP to namespace `name` if it requests
+// one, and releases its allocation otherwise. An allocation is kept unless
+// AllocationOutdated.
+func (c *Controller) syncNamespace(ctx context.Context, name string) error {
+	ns, err := c.namespaceInformer.Lister().Get(name)
+	if apierrors.IsNotFound(err) {
+		return c.releaseEgressIP(ctx, name, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	machineSet := ns.Annotations[AnnotationEgressIPRequest]
+	if machineSet == "" || ns.DeletionTimestamp != nil {
+		return c.releaseEgressIP(ctx, name, ns)
+	}
+
+	cidrs := c.cidrs.Get(machineSet)
+	alloc, ok := c.allocation(name)
+	if ok && AllocationOutdated(alloc, machineSet, c.cidrs) {
+		klog.Infof("Namespace<%s>: %s of MachineSet %s outdated, requested from MachineSet %s",
+			name, alloc.IP, alloc.MachineSet, machineSet)
+		if err := c.releaseEgressIP(ctx, name, ns); err != nil {
+			return err
+		}
+		ok = false
+	}
+	if !ok {
+		if len(cidrs) == 0 {
+			klog.Errorf("Namespace<%s>: MachineSet %s has no egress CIDRs", name, machineSet)
+			c.recordNamespaceEvent(ns, corev1.EventTypeWarning, ReasonEgressIPAllocationFailed,
+				"MachineSet %s has no egress CIDRs", machineSet)
+			return nil
+		}
+		if alloc, err = c.allocateEgressIP(ctx, ns, machineSet, cidrs); err != nil {
+			return err
+		}
+		if alloc.IP == "" {
+			return nil
+		}
+	}
+
+	return c.applyAllocation(ctx, ns, alloc)
+}
+
+// allocateEgressIP allocates and persists the next free IP within `cidrs`
+// for `ns`. Returns an empty Allocation if there is no free IP.
+func (c *Controller) allocateEgressIP(ctx context.Context, ns *corev1.Namespace, machineSet string, cidrs []v1.HostSubnetEgressCIDR) (Allocation, error) {
+	used, err := c.usedEgressIPs(ns.Name, machineSet)
+	if err != nil {
+		return Allocation{}, err
+	}
+	ip, err := NextFreeIP(cidrs, used)
+	if err != nil {
+		klog.Errorf("Namespace<%s>: allocate egress IP from MachineSet %s: %s", ns.Name, machineSet, err)
+		c.recordNamespaceEvent(ns, corev1.EventTypeWarning, ReasonEgressIPAllocationFailed,
+			"Cannot allocate egress IP from MachineSet %s: %s", machineSet, err)
+		return Allocation{}, nil
+	}
+
+	alloc := Allocation{MachineSet: machineSet, IP: ip}
+	if err := c.updateAllocation(ctx, ns.Name, &alloc); err != nil {
+		return Allocation{}, err
+	}
+
+	klog.Infof("Namespace<%s>: allocated egress IP %s from MachineSet %s", ns.Name, ip, machineSet)
+	c.recordNamespaceEvent(ns, corev1.EventTypeNormal, ReasonEgressIPAllocated,
+		"Allocated egress IP %s from MachineSet %s", ip, machineSet)
+	return alloc, nil
+}
+
+// usedEgressIPs returns all IPs which must not be allocated to namespace
+// `name` from `machineSet`: other allocations, egress IPs of other
+// NetNamespaces and of HostSubnets, node IPs, the egress IPs of all
+// MachineSets and the IPs reserved on `machineSet`.
+func (c *Controller) usedEgressIPs(name, machineSet string) (map[string]bool, error) {
+	used := make(map[string]bool)
+	c.allocationMutex.Lock()
+	for ns, alloc := range c.allocations {
+		if ns != name {
+			used[string(alloc.IP)] = true
+		}
+	}
+	c.allocationMutex.Unlock()
+
+	netNamespaces, err := c.netNamespaceInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, netns := range netNamespaces {
+		if netns.Name == name {
+			continue
+		}
+		for _, ip := range netns.EgressIPs {
+			used[string(ip)] = true
+		}
+	}
+
+	hostSubnets, err := c.hostSubnets.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, hs := range hostSubnets {
+		used[hs.HostIP] = true
+		for _, ip := range hs.EgressIPs {
+			used[string(ip)] = true
+		}
+	}
+
+	for _, ip := range c.cidrs.AllIPs() {
+		used[string(ip)] = true
+	}
+
+	if ms, err := c.machineSets.Get(machineSet); err == nil {
+		reserved, err := parseEgressIPs(ms.Annotations[AnnotationReservedIPs])
+		if err != nil {
+			klog.Errorf("MachineSet<%s>: invalid annotation '%s': %s", ms.Name, AnnotationReservedIPs, err)
+			c.recorder.Eventf(ms, corev1.EventTypeWarning, ReasonInvalidAnnotation,
+				"Not allocating egress IPs, annotation %s is invalid: %s", AnnotationReservedIPs, err)
+			return nil, err
+		}
+		for _, ip := range reserved {
+			used[string(ip)] = true
+		}
+	}
+	return used, nil
+}
+
+// applyAllocation sets the egressIPs of the NetNamespace of `ns` to the
+// allocated IP, and annotates `ns` with it.
+func (c *Controller) applyAllocation(ctx context.Context, ns *corev1.Namespace, alloc Allocation) error {
+	netns, err := c.netNamespaceInformer.Lister().Get(ns.Name)
+	if apierrors.IsNotFound(err) {
+		// Enqueued again once the NetNamespace is created
+		klog.V(4).Infof("Namespace<%s>: no NetNamespace yet", ns.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	desired := []v1.NetNamespaceEgressIP{alloc.IP}
+	if !equalNetNamespaceIPs(netns.EgressIPs, desired) {
+		klog.Infof("NetNamespace<%s>: setting egressIPs to %v (was %v)", ns.Name, desired, netns.EgressIPs)
+		if err := c.patchNetNamespace(ctx, ns.Name, desired); err != nil {
+			c.recordNamespaceEvent(ns, corev1.EventTypeWarning, ReasonEgressIPAllocationFailed,
+				"Failed to set egressIPs of NetNamespace to %v: %s", desired, err)
+			return err
+		}
+	}
+
+	ip := string(alloc.IP)
+	if ns.Annotations[AnnotationEgressIPAllocated] != ip {
+		return c.annotateNamespace(ctx, ns.Name, &ip)
+	}
+	return nil
+}
+
+// releaseEgressIP drops the allocation of namespace `name`. If the namespace
+// still exists, the IP is removed from its NetNamespace first, so it's never
+// allocated twice.
+func (c *Controller) releaseEgressIP(ctx context.Context, name string, ns *corev1.Namespace) error {
+	alloc, ok := c.allocation(name)
+	if !ok {
+		return nil
+	}
+
+	if ns != nil {
+		netns, err := c.netNamespaceInformer.Lister().Get(name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if err == nil && equalNetNamespaceIPs(netns.EgressIPs, []v1.NetNamespaceEgressIP{alloc.IP}) {
+			klog.Infof("NetNamespace<%s>: clearing egressIPs %v", name, netns.EgressIPs)
+			if err := c.patchNetNamespace(ctx, name, nil); err != nil {
+				return err
+			}
+		}
+		if _, ok := ns.Annotations[AnnotationEgressIPAllocated]; ok {
+			if err := c.annotateNamespace(ctx, name, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := c.updateAllocation(ctx, name, nil); err != nil {
+		return err
+	}
+
+	klog.Infof("Namespace<%s>: released egress IP %s of MachineSet %s", name, alloc.IP, alloc.MachineSet)
+	if ns != nil {
+		c.recordNamespaceEvent(ns, corev1.EventTypeNormal, ReasonEgressIPReleased,
+			"Released egress IP %s of MachineSet %s", alloc.IP, alloc.MachineSet)
+	}
+	return nil
+}
+
+// updateAllocation sets the allocation of namespace `name` to `alloc`, or
+// removes it if `alloc` is nil, and persists all allocations. The change is
+// visible while the ConfigMap is written, but the allocationMutex isn't held
+// meanwhile, so readers don't wait for the API server. If persisting fails,
+// the change is rolled back.
+func (c *Controller) updateAllocation(ctx context.Context, name string, alloc *Allocation) error {
+	c.persistMutex.Lock()
+	defer c.persistMutex.Unlock()
+
+	c.allocationMutex.Lock()
+	prev, existed := c.allocations[name]
+	if alloc != nil {
+		c.allocations[name] = *alloc
+	} else {
+		delete(c.allocations, name)
+	}
+	snapshot := make(Allocations, len(c.allocations))
+	for ns, a := range c.allocations {
+		snapshot[ns] = a
+	}
+	c.allocationMutex.Unlock()
+
+	if err := c.persistAllocations(ctx, snapshot); err != nil {
+		c.allocationMutex.Lock()
+		if existed {
+			c.allocations[name] = prev
+		} else {
+			delete(c.allocations, name)
+		}
+		c.allocationMutex.Unlock()
+		return fmt.Errorf("persist allocations: %w", err)
+	}
+	return nil
+}
+
+// persistAllocations writes `allocations` to the ConfigMap. The caller must
+// hold the persistMutex.
+func (c *Controller) persistAllocations(ctx context.Context, allocations Allocations) error {
+	store := c.allocationStore
+	data, err := allocations.Encode()
+	if err != nil {
+		return err
+	}
+	if c.current().dryRun {
+		klog.Infof("ConfigMap<%s>: dry run, not persisting %d allocations", store, len(data))
+		return nil
+	}
+
+	client := c.kubeClient.CoreV1().ConfigMaps(store.Namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := client.Get(ctx, store.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			_, err = client.Create(ctx, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: store.Name, Namespace: store.Namespace},
+				Data:       data,
+			}, metav1.CreateOptions{FieldManager: FieldManager})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		cm = cm.DeepCopy()
+		cm.Data = data
+		_, err = client.Update(ctx, cm, metav1.UpdateOptions{FieldManager: FieldManager})
+		return err
+	})
+}
+
+// patchNetNamespace sets the egressIPs of NetNamespace `name`.
+func (c *Controller) patchNetNamespace(ctx context.Context, name string, ips []v1.NetNamespaceEgressIP) error {
+	if ips == nil {
+		// A null value would remove the field instead of clearing it
+		ips = []v1.NetNamespaceEgressIP{}
+	}
+	data, err := json.Marshal(map[string]interface{}{"egressIPs": ips})
+	if err != nil {
+		return err
+	}
+	if c.current().dryRun {
+		klog.Infof("NetNamespace<%s>: dry run, not applying %s: %s", name, types.MergePatchType, data)
+		return nil
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		_, err := c.netNamespaceClient.Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{
+			FieldManager: FieldManager,
+		})
+		return err
+	})
+}
+
+// annotateNamespace sets AnnotationEgressIPAllocated on Namespace `name`, or
+// removes it if `ip` is nil.
+func (c *Controller) annotateNamespace(ctx context.Context, name string, ip *string) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{AnnotationEgressIPAllocated: ip},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if c.current().dryRun {
+		klog.Infof("Namespace<%s>: dry run, not applying %s: %s", name, types.MergePatchType, data)
+		return nil
+	}
+
+	_, err = c.kubeClient.CoreV1().Namespaces().Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{
+		FieldManager: FieldManager,
+	})
+	return err
+}
+
+// recordNamespaceEvent records an event on `ns`.
+func (c *Controller) recordNamespaceEvent(ns *corev1.Namespace, eventtype, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	if c.current().dryRun {
+		message = "Dry run: " + message
+	}
+	c.recorder.Event(ns, eventtype, reason, message)
+}
+
+func equalNetNamespaceIPs(this, other []v1.NetNamespaceEgressIP) bool {
+	if len(this) != len(other) {
+		return false
+	}
+	for i := range this {
+		if this[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
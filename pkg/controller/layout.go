@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// NodeRoleLabelPrefix is the prefix of the Node labels holding its roles, e.g.
+// node-role.kubernetes.io/master.
+const NodeRoleLabelPrefix = "node-role.kubernetes.io/"
+
+// Layout describes where the operator finds Machines and MachineSets and
+// which labels and annotations it reads. The zero value is not valid, start
+// from DefaultLayout.
+type Layout struct {
+	// MachineNamespace is the namespace of Machines and MachineSets.
+	MachineNamespace string
+	// EgressCIDRsAnnotation is the MachineSet annotation holding the CIDRs.
+	EgressCIDRsAnnotation string
+	// EgressIPsAnnotation is the MachineSet annotation holding the egress IPs.
+	EgressIPsAnnotation string
+	// MachineSetLabel is the Machine label holding the MachineSet name.
+	MachineSetLabel string
+	// RoleLabel is the Machine label holding the role.
+	RoleLabel string
+	// IgnoredRoles are never managed. Empty to manage all Machines.
+	IgnoredRoles []string
+	// NodeSubnetPrefix is the prefix length of the primary subnet of the
+	// nodes. If set, egress CIDRs outside of the subnet of a node's
+	// InternalIP are not applied to it. 0 disables the check.
+	NodeSubnetPrefix int
+}
+
+// DefaultLayout returns the layout of a standard OpenShift 4 cluster. Masters
+// are ignored.
+func DefaultLayout() Layout {
+	return Layout{
+		MachineNamespace:      MachineNamespace,
+		EgressCIDRsAnnotation: AnnotationEgressCIDRS,
+		EgressIPsAnnotation:   AnnotationEgressIPs,
+		MachineSetLabel:       MachinesetLabel,
+		RoleLabel:             RoleLabel,
+		IgnoredRoles:          []string{"master"},
+	}
+}
+
+// Validate checks that all fields are set to valid values.
+func (l Layout) Validate() error {
+	var errs []string
+	if msgs := validation.IsDNS1123Label(l.MachineNamespace); len(msgs) > 0 {
+		errs = append(errs, fmt.Sprintf("machine namespace %q: %s", l.MachineNamespace, strings.Join(msgs, ", ")))
+	}
+	for name, key := range map[string]string{
+		"egress CIDRs annotation": l.EgressCIDRsAnnotation,
+		"egress IPs annotation":   l.EgressIPsAnnotation,
+		"machineset label":        l.MachineSetLabel,
+		"role label":              l.RoleLabel,
+	} {
+		if msgs := validation.IsQualifiedName(key); len(msgs) > 0 {
+			errs = append(errs, fmt.Sprintf("%s %q: %s", name, key, strings.Join(msgs, ", ")))
+		}
+	}
+	if l.EgressIPsAnnotation == l.EgressCIDRsAnnotation {
+		errs = append(errs, fmt.Sprintf("egress IPs annotation %q: must differ from the egress CIDRs annotation", l.EgressIPsAnnotation))
+	}
+	if l.NodeSubnetPrefix < 0 || l.NodeSubnetPrefix > 32 {
+		errs = append(errs, fmt.Sprintf("node subnet prefix %d: must be between 0 and 32", l.NodeSubnetPrefix))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Ignores returns true if Machine `m` has one of the IgnoredRoles.
+func (l Layout) Ignores(m *v1beta1.Machine) bool {
+	role := l.RoleOf(m)
+	for _, r := range l.IgnoredRoles {
+		if role == r {
+			return true
+		}
+	}
+	return false
+}
+
+// IgnoresNode returns true if Node `n` has the node role label of one of the
+// IgnoredRoles.
+func (l Layout) IgnoresNode(n *corev1.Node) bool {
+	for _, r := range l.IgnoredRoles {
+		if _, ok := n.Labels[NodeRoleLabelPrefix+r]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleOf returns the role of Machine `m`.
+func (l Layout) RoleOf(m *v1beta1.Machine) string {
+	return m.Labels[l.RoleLabel]
+}
+
+// MachineSetOf returns the name of the MachineSet of Machine `m`.
+func (l Layout) MachineSetOf(m *v1beta1.Machine) string {
+	return m.Labels[l.MachineSetLabel]
+}
+
+// EgressCIDRsOf returns the egress CIDR annotation of MachineSet `ms`.
+func (l Layout) EgressCIDRsOf(ms *v1beta1.MachineSet) string {
+	return ms.Annotations[l.EgressCIDRsAnnotation]
+}
+
+// EgressIPsOf returns the egress IPs annotation of MachineSet `ms`.
+func (l Layout) EgressIPsOf(ms *v1beta1.MachineSet) string {
+	return ms.Annotations[l.EgressIPsAnnotation]
+}
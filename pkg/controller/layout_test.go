@@ -0,0 +1,26 @@
+package controller_test
+
+import (
+	"testing"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	"github.com/matryer/is"
+)
+
+func TestLayoutValidate(t *testing.T) {
+	is := is.New(t)
+	is.NoErr(controller.DefaultLayout().Validate())
+
+	layout := controller.DefaultLayout()
+	layout.MachineNamespace = "Not_A_Namespace"
+	layout.RoleLabel = ""
+	is.True(layout.Validate() != nil)
+
+	layout = controller.DefaultLayout()
+	layout.NodeSubnetPrefix = 33
+	is.True(layout.Validate() != nil)
+
+	layout = controller.DefaultLayout()
+	layout.EgressIPsAnnotation = layout.EgressCIDRsAnnotation
+	is.True(layout.Validate() != nil)
+}
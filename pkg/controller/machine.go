@@ -1,11 +1,13 @@
 package controller
 
 import (
-	"time"
+	"errors"
+	"strings"
 
 	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
 	"github.com/openshift/machine-api-operator/pkg/generated/clientset/versioned"
 	"github.com/openshift/machine-api-operator/pkg/generated/informers/externalversions"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
@@ -18,12 +20,27 @@ func (c *Controller) createMachineInformer() {
 	}
 
 	// what is this, Java?
+	namespace := c.current().layout.MachineNamespace
 	factory := externalversions.NewSharedInformerFactoryWithOptions(
 		clientset,
-		time.Hour,
-		externalversions.WithNamespace(MachineNamespace),
+		c.resyncPeriod,
+		externalversions.WithNamespace(namespace),
 	)
 	machineInformer := factory.Machine().V1beta1().Machines()
+	if err := machineInformer.Informer().AddIndexers(MachineIndexers); err != nil {
+		klog.Fatalln(err)
+	}
+	machineInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			m := obj.(*v1beta1.Machine)
+			c.AddMachine(m)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldM := oldObj.(*v1beta1.Machine)
+			newM := newObj.(*v1beta1.Machine)
+			c.UpdateMachine(oldM, newM)
+		},
+	})
 	machineSetInformer := factory.Machine().V1beta1().MachineSets()
 	machineSetInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
@@ -36,7 +53,11 @@ func (c *Controller) createMachineInformer() {
 			c.UpdateMachineSet(oldMs, newMs)
 		},
 		DeleteFunc: func(obj interface{}) {
-			ms := obj.(*v1beta1.MachineSet)
+			ms, ok := deletedObject(obj).(*v1beta1.MachineSet)
+			if !ok {
+				klog.Errorf("MachineSet deleted: unexpected object %T", obj)
+				return
+			}
 			c.DeleteMachineSet(ms)
 		},
 	})
@@ -44,49 +65,223 @@ func (c *Controller) createMachineInformer() {
 	c.machineInformerFactory = factory
 	c.machineSetInformer = machineSetInformer
 	c.machineInformer = machineInformer
-	c.machines = machineInformer.Lister().Machines(MachineNamespace)
-	c.machineSets = machineSetInformer.Lister().MachineSets(MachineNamespace)
+	c.machines = machineInformer.Lister().Machines(namespace)
+	c.machineSets = machineSetInformer.Lister().MachineSets(namespace)
 }
 
 func (c *Controller) AddMachineSet(ms *v1beta1.MachineSet) {
-	cidrs := ms.Annotations[AnnotationEgressCIDRS]
+	c.syncMachineSet(ms)
+}
+
+func (c *Controller) UpdateMachineSet(_, ms *v1beta1.MachineSet) {
+	c.syncMachineSet(ms)
+}
+
+func (c *Controller) DeleteMachineSet(ms *v1beta1.MachineSet) {
+	c.cidrs.Delete(ms.Name)
+	c.cidrs.DeleteIPs(ms.Name)
+	// Orphaned Machines might still be around and need to be released
+	c.triggerReconcile(ms.Name)
+	c.enqueuePolicySync()
+	c.enqueueAllocations(ms.Name)
+	c.retryRefused()
+}
+
+// syncMachineSet updates the CIDRMap entry of `ms` from its annotations and
+// triggers a reconcilation of its HostSubnets if anything changed. Changes
+// stranding egress IPs of NetNamespaces are refused, see guardCIDRs.
+func (c *Controller) syncMachineSet(ms *v1beta1.MachineSet) {
+	c.syncEgressIPs(ms)
+
+	current := c.current()
+	annotation := current.layout.EgressCIDRsAnnotation
+	cidrs := ms.Annotations[annotation]
+	defer c.enqueuePolicySync()
+	defer c.enqueueAllocations(ms.Name)
 
 	if cidrs == "" {
-		c.cidrs.Delete(ms.Name)
+		if !c.policyOwned(ms.Name) && c.cidrs.Exists(ms.Name) && !c.guardCIDRs(ms, nil) {
+			return
+		}
+		if c.dropAnnotation(ms.Name) {
+			c.triggerReconcile(ms.Name)
+			c.retryRefused()
+		}
+		return
+	}
+
+	release := c.releasePolicy(ms)
+	if c.cidrs.Equals(ms.Name, cidrs) && c.cidrs.ReleasePolicy(ms.Name) == release {
+		return
+	}
+
+	if overlaps := c.cidrs.Overlapping(ms.Name, cidrs); len(overlaps) > 0 {
+		msg := joinOverlaps(overlaps)
+		if current.strictOverlaps {
+			klog.Errorf("MachineSet<%s>: refusing annotation '%s': %s", ms.Name, annotation, msg)
+			c.recorder.Eventf(ms, corev1.EventTypeWarning, ReasonOverlap,
+				"Refusing annotation %s, keeping %v: %s", annotation, c.cidrs.Get(ms.Name), msg)
+			return
+		}
+		klog.Warningf("MachineSet<%s>: %s", ms.Name, msg)
+		c.recorder.Eventf(ms, corev1.EventTypeWarning, ReasonOverlap, "%s", msg)
+	}
+
+	if proposed, err := parseCIDRs(cidrs); err == nil && !c.guardCIDRs(ms, proposed) {
 		return
 	}
 
-	c.cidrs.Set(ms.Name, cidrs)
+	if err := c.cidrs.Set(ms.Name, cidrs); err != nil {
+		reason := ReasonInvalidAnnotation
+		var reservedErr *ReservedCIDRError
+		if errors.As(err, &reservedErr) {
+			reason = ReasonReservedNetwork
+		}
+		if c.cidrs.Exists(ms.Name) {
+			klog.Errorf("MachineSet<%s>: invalid annotation '%s', keeping previous value: %s",
+				ms.Name, annotation, err)
+			c.recorder.Eventf(ms, corev1.EventTypeWarning, reason,
+				"Keeping previous value %v, annotation %s is invalid: %s", c.cidrs.Get(ms.Name), annotation, err)
+			return
+		}
+		klog.Errorf("MachineSet<%s>: invalid annotation '%s': %s", ms.Name, annotation, err)
+		c.recorder.Eventf(ms, corev1.EventTypeWarning, reason,
+			"Ignoring invalid annotation %s: %s", annotation, err)
+		return
+	}
+	c.cidrs.SetReleasePolicy(ms.Name, release)
 	c.triggerReconcile(ms.Name)
+	c.retryRefused()
 }
 
-func (c *Controller) UpdateMachineSet(_, ms *v1beta1.MachineSet) {
-	cidrs := ms.Annotations[AnnotationEgressCIDRS]
+// retryRefused syncs all MachineSets whose annotation was refused because of
+// overlaps and which no longer overlap.
+func (c *Controller) retryRefused() {
+	current := c.current()
+	if !current.strictOverlaps {
+		return
+	}
 
-	if cidrs == "" {
-		c.cidrs.Delete(ms.Name)
+	machineSets, err := c.machineSets.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("list machinesets: %s", err)
 		return
 	}
+	for _, ms := range machineSets {
+		cidrs := current.layout.EgressCIDRsOf(ms)
+		if cidrs == "" || c.cidrs.Equals(ms.Name, cidrs) || c.policyOwned(ms.Name) {
+			continue
+		}
+		if err := c.cidrs.Validate(cidrs); err != nil {
+			// Rejected, not refused
+			continue
+		}
+		if len(c.cidrs.Overlapping(ms.Name, cidrs)) == 0 {
+			c.syncMachineSet(ms)
+		}
+	}
+}
 
-	if !c.cidrs.Equals(ms.Name, cidrs) {
-		c.cidrs.Set(ms.Name, cidrs)
-		c.triggerReconcile(ms.Name)
+func joinOverlaps(overlaps []Overlap) string {
+	msgs := make([]string, len(overlaps))
+	for i := range overlaps {
+		msgs[i] = overlaps[i].String()
 	}
+	return strings.Join(msgs, ", ")
 }
 
-func (c *Controller) DeleteMachineSet(ms *v1beta1.MachineSet) {
-	c.cidrs.Delete(ms.Name)
+// releasePolicy returns the ReleasePolicy of `ms`, falling back to the
+// global default.
+func (c *Controller) releasePolicy(ms *v1beta1.MachineSet) ReleasePolicy {
+	policy, err := releasePolicyOf(ms, c.current().defaultRelease)
+	if err != nil {
+		klog.Errorf("MachineSet<%s>: %s, using %s", ms.Name, err, policy)
+		c.recorder.Eventf(ms, corev1.EventTypeWarning, ReasonInvalidAnnotation,
+			"Ignoring annotation %s: %s", AnnotationOnRelease, err)
+	}
+	return policy
 }
 
-// triggerReconcile will list all machines in the given Machineset and trigger a
-// reconcilation for each HostSubnet in it.
-func (c *Controller) triggerReconcile(machineset string) {
-	selector, err := labels.Parse(MachinesetLabel + "=" + machineset)
+// releasePolicyOf returns the ReleasePolicy of `ms`, or `def` if it has none
+// or an invalid one.
+func releasePolicyOf(ms *v1beta1.MachineSet, def ReleasePolicy) (ReleasePolicy, error) {
+	v, ok := ms.Annotations[AnnotationOnRelease]
+	if !ok {
+		return def, nil
+	}
+
+	policy, err := ParseReleasePolicy(v)
 	if err != nil {
-		klog.Error("creating label selector:", err)
+		return def, err
+	}
+	return policy, nil
+}
+
+// dropAnnotation removes the CIDRMap entry of a MachineSet without
+// annotation, unless the entry is managed by a policy. Returns true if an
+// entry was removed.
+func (c *Controller) dropAnnotation(machineSet string) bool {
+	if c.policyOwned(machineSet) || !c.cidrs.Exists(machineSet) {
+		return false
+	}
+	c.cidrs.Delete(machineSet)
+	return true
+}
+
+func (c *Controller) AddMachine(m *v1beta1.Machine) {
+	c.invalidateAssignment(c.current().layout.MachineSetOf(m))
+	c.enqueueMachine(m)
+}
+
+// UpdateMachine enqueues the Machine's HostSubnet if the Machine moved to
+// another MachineSet, changed its role, got (re)linked to a node or is being
+// deleted.
+func (c *Controller) UpdateMachine(oldM, m *v1beta1.Machine) {
+	layout := c.current().layout
+	if layout.MachineSetOf(oldM) == layout.MachineSetOf(m) &&
+		layout.RoleOf(oldM) == layout.RoleOf(m) &&
+		nodeRefName(oldM) == nodeRefName(m) &&
+		(oldM.DeletionTimestamp == nil) == (m.DeletionTimestamp == nil) {
+		return
+	}
+
+	// Any of these changes the egress IP members
+	c.invalidateAssignment(layout.MachineSetOf(oldM))
+	c.invalidateAssignment(layout.MachineSetOf(m))
+
+	// The previous node is no longer backed by this Machine, so it might
+	// belong elsewhere now.
+	if old := nodeRefName(oldM); old != "" && old != nodeRefName(m) {
+		c.enqueue(old)
+	}
+	c.enqueueMachine(m)
+}
+
+// enqueueMachine enqueues the HostSubnet of the node backed by Machine `m`.
+func (c *Controller) enqueueMachine(m *v1beta1.Machine) {
+	node, err := c.index.NodeForMachine(m)
+	if err != nil {
+		klog.Errorf("Machine<%s>: resolve node: %s", m.Name, err)
+		return
+	}
+	if node == "" {
+		klog.V(8).Infof("Machine<%s>: no node yet, skipping", m.Name)
 		return
 	}
+	c.enqueue(node)
+}
+
+func nodeRefName(m *v1beta1.Machine) string {
+	if m.Status.NodeRef == nil {
+		return ""
+	}
+	return m.Status.NodeRef.Name
+}
 
+// triggerReconcile will list all machines in the given Machineset and enqueue a
+// reconcilation for each HostSubnet in it.
+func (c *Controller) triggerReconcile(machineset string) {
+	selector := labels.SelectorFromSet(labels.Set{c.current().layout.MachineSetLabel: machineset})
 	machines, err := c.machines.List(selector)
 	if err != nil {
 		klog.Error("list machines:", err)
@@ -94,12 +289,6 @@ func (c *Controller) triggerReconcile(machineset string) {
 	}
 
 	for _, m := range machines {
-		hs, err := c.hostSubnets.Get(m.Name)
-		if err != nil {
-			klog.Error("get hostsubnet", err)
-			return
-		}
-
-		ReconcileSubnet(hs, c.cidrs, c.machines.Get, c.hostSubnetClient.Update)
+		c.enqueueMachine(m)
 	}
 }
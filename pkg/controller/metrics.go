@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	v1 "github.com/openshift/api/network/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/klog/v2"
+)
+
+const metricsNamespace = "machineset_egress_cidr_operator"
+
+var (
+	reconcileTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconcile_total",
+		Help:      "Number of HostSubnet reconciliations by result and MachineSet.",
+	}, []string{"result", "machineset"})
+
+	updateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "hostsubnet_update_duration_seconds",
+		Help:      "Latency of HostSubnet egressCIDRs updates.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	dryRunPatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dry_run_patches_total",
+		Help:      "Number of HostSubnet patches skipped because of dry run mode, by MachineSet.",
+	}, []string{"machineset"})
+
+	leaderStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "1 if this instance holds the leader lease, 0 otherwise.",
+	}, []string{"name"})
+
+	managedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "managed_hostsubnets"),
+		"Number of HostSubnets whose egressCIDRs are managed, by MachineSet (or node/<name> for policy node selectors).",
+		[]string{"machineset"}, nil,
+	)
+	outOfSyncDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "out_of_sync_hostsubnets"),
+		"Number of managed HostSubnets whose egressCIDRs differ from the desired value, by MachineSet (or node/<name> for policy node selectors).",
+		[]string{"machineset"}, nil,
+	)
+	networkTypeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "network_type"),
+		"Network type the operator writes egress CIDRs for, always 1.",
+		[]string{"type"}, nil,
+	)
+	overlapDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "cidr_overlaps"),
+		"Number of overlapping CIDRs between two CIDRMap entries (MachineSets or node/<name> for policy node selectors), or with the egress IPs of other_key.",
+		[]string{"key", "other_key"}, nil,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(reconcileTotal, updateDuration, dryRunPatches, leaderStatus)
+	leaderelection.SetProvider(leaderMetricsProvider{})
+}
+
+// timedPatch is a HostSubnetPatcher which observes the latency of each call.
+func (c *Controller) timedPatch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*v1.HostSubnet, error) {
+	start := time.Now()
+	defer func() {
+		updateDuration.Observe(time.Since(start).Seconds())
+	}()
+	return c.hostSubnetClient.Patch(ctx, name, pt, data, opts, subresources...)
+}
+
+// machineSetForNode returns the name of the MachineSet the node belongs to, or
+// an empty string if unknown.
+func (c *Controller) machineSetForNode(node string) string {
+	m, err := c.index.MachineForNode(node)
+	if err != nil {
+		return ""
+	}
+	return c.current().layout.MachineSetOf(m)
+}
+
+// Collector returns a prometheus.Collector reporting the state of all
+// HostSubnets as seen by the informer caches.
+func (c *Controller) Collector() prometheus.Collector {
+	return stateCollector{c}
+}
+
+type stateCollector struct {
+	c *Controller
+}
+
+func (s stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- managedDesc
+	ch <- outOfSyncDesc
+	ch <- overlapDesc
+	ch <- networkTypeDesc
+}
+
+func (s stateCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(networkTypeDesc, prometheus.GaugeValue, 1, string(s.c.networkType))
+
+	overlaps := make(map[[2]string]int)
+	for _, o := range s.c.cidrs.Overlaps() {
+		overlaps[[2]string{o.Key, o.OtherKey}]++
+	}
+	for keys, n := range overlaps {
+		ch <- prometheus.MustNewConstMetric(overlapDesc, prometheus.GaugeValue, float64(n), keys[0], keys[1])
+	}
+
+	nodes, err := s.c.target.nodes()
+	if err != nil {
+		klog.Errorf("metrics: list nodes: %s", err)
+		return
+	}
+
+	managed := make(map[string]int)
+	outOfSync := make(map[string]int)
+	layout := s.c.current().layout
+	for _, node := range nodes {
+		// Node selector entries take precedence, as in reconcileObject
+		key := NodeKey(node)
+		if !s.c.cidrs.Exists(key) {
+			key = s.c.machineSetForNode(node)
+		}
+		if key == "" || !s.c.cidrs.Exists(key) {
+			continue
+		}
+		managed[key]++
+		if !s.c.target.inSync(layout, node, s.c.cidrs.Get(key)) {
+			outOfSync[key]++
+		}
+	}
+
+	for ms, n := range managed {
+		ch <- prometheus.MustNewConstMetric(managedDesc, prometheus.GaugeValue, float64(n), ms)
+		ch <- prometheus.MustNewConstMetric(outOfSyncDesc, prometheus.GaugeValue, float64(outOfSync[ms]), ms)
+	}
+}
+
+type leaderMetricsProvider struct{}
+
+func (leaderMetricsProvider) NewLeaderMetric() leaderelection.SwitchMetric {
+	return leaderMetric{}
+}
+
+type leaderMetric struct{}
+
+func (leaderMetric) On(name string) {
+	leaderStatus.WithLabelValues(name).Set(1)
+}
+
+func (leaderMetric) Off(name string) {
+	leaderStatus.WithLabelValues(name).Set(0)
+}
@@ -0,0 +1,53 @@
+package controller_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	"github.com/matryer/is"
+	v1 "github.com/openshift/api/network/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCollectorOutOfSync(t *testing.T) {
+	is := is.New(t)
+	opts := mockOptions(controller.ReleaseKeep)
+	opts.Layout.NodeSubnetPrefix = 24
+
+	// 10.1.0.0/24 is unreachable from node01 and skipped by reconcile
+	m1 := mockMachine("worker-a", "worker")
+	m1.Status.NodeRef = &corev1.ObjectReference{Name: "node01"}
+	m1.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.5"}}
+	hs1 := mockHostSubnet("node01")
+	hs1.EgressCIDRs = []v1.HostSubnetEgressCIDR{"10.0.0.128/25"}
+	// Lacks the reachable 10.1.0.0/24
+	m2 := mockMachine("worker-b", "worker")
+	m2.Status.NodeRef = &corev1.ObjectReference{Name: "node02"}
+	hs2 := mockHostSubnet("node02")
+	hs2.HostIP = "10.1.0.5"
+	// Selected by a node selector, without a Machine
+	hs3 := mockHostSubnet("node03")
+	hs3.HostIP = "10.0.0.7"
+	hs3.EgressCIDRs = []v1.HostSubnetEgressCIDR{"10.0.0.0/25"}
+
+	c := controller.NewTestController(opts, record.NewFakeRecorder(10), m1, m2, hs1, hs2, hs3)
+	is.NoErr(c.CIDRs().Set("worker", "10.0.0.128/25,10.1.0.0/24"))
+	is.NoErr(c.CIDRs().Set(controller.NodeKey("node03"), "10.0.0.0/25,192.0.2.0/24"))
+
+	expected := `
+# HELP machineset_egress_cidr_operator_managed_hostsubnets Number of HostSubnets whose egressCIDRs are managed, by MachineSet (or node/<name> for policy node selectors).
+# TYPE machineset_egress_cidr_operator_managed_hostsubnets gauge
+machineset_egress_cidr_operator_managed_hostsubnets{machineset="node/node03"} 1
+machineset_egress_cidr_operator_managed_hostsubnets{machineset="worker"} 2
+# HELP machineset_egress_cidr_operator_out_of_sync_hostsubnets Number of managed HostSubnets whose egressCIDRs differ from the desired value, by MachineSet (or node/<name> for policy node selectors).
+# TYPE machineset_egress_cidr_operator_out_of_sync_hostsubnets gauge
+machineset_egress_cidr_operator_out_of_sync_hostsubnets{machineset="node/node03"} 0
+machineset_egress_cidr_operator_out_of_sync_hostsubnets{machineset="worker"} 1
+`
+	is.NoErr(testutil.CollectAndCompare(c.Collector(), strings.NewReader(expected),
+		"machineset_egress_cidr_operator_managed_hostsubnets",
+		"machineset_egress_cidr_operator_out_of_sync_hostsubnets"))
+}
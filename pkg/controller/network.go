@@ -1,8 +1,6 @@
 package controller
 
 import (
-	"time"
-
 	v1 "github.com/openshift/api/network/v1"
 	"github.com/openshift/client-go/network/clientset/versioned"
 	"github.com/openshift/client-go/network/informers/externalversions"
@@ -16,7 +14,7 @@ func (c *Controller) createNetworkInformer() {
 		klog.Fatal(err)
 	}
 
-	factory := externalversions.NewSharedInformerFactory(clientset, time.Hour)
+	factory := externalversions.NewSharedInformerFactory(clientset, c.resyncPeriod)
 	informer := factory.Network().V1().HostSubnets()
 	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
@@ -29,23 +27,44 @@ func (c *Controller) createNetworkInformer() {
 			c.UpdateHostSubnet(oldMs, newMs)
 		},
 		DeleteFunc: func(obj interface{}) {
-			ms := obj.(*v1.HostSubnet)
-			c.DeleteHostSubnet(ms)
+			hs, ok := deletedObject(obj).(*v1.HostSubnet)
+			if !ok {
+				klog.Errorf("HostSubnet deleted: unexpected object %T", obj)
+				return
+			}
+			c.DeleteHostSubnet(hs)
 		},
 	})
 
+	// NetNamespaces are checked before egress CIDRs are removed, and
+	// written to by the egress IP allocator
+	netNamespaceInformer := factory.Network().V1().NetNamespaces()
+	netNamespaceInformer.Informer()
+
 	c.networkInformerFactory = factory
 	c.hostSubNetInformer = informer
+	c.netNamespaceInformer = netNamespaceInformer
+	c.netNamespaces = netNamespaceInformer.Lister()
 	c.hostSubnets = informer.Lister()
 	c.hostSubnetClient = clientset.NetworkV1().HostSubnets()
+	c.netNamespaceClient = clientset.NetworkV1().NetNamespaces()
 }
 
 func (c *Controller) AddHostSubnet(hs *v1.HostSubnet) {
-	ReconcileSubnet(hs, c.cidrs, c.machines.Get, c.hostSubnetClient.Update)
+	c.invalidateAssignment(c.machineSetForNode(hs.Name))
+	c.enqueue(hs.Name)
 }
 
 func (c *Controller) UpdateHostSubnet(_, hs *v1.HostSubnet) {
-	ReconcileSubnet(hs, c.cidrs, c.machines.Get, c.hostSubnetClient.Update)
+	c.enqueue(hs.Name)
+	// Keep the sync state in the policy status up to date
+	c.enqueuePolicySync()
 }
 
-func (c *Controller) DeleteHostSubnet(hs *v1.HostSubnet) {}
+func (c *Controller) DeleteHostSubnet(hs *v1.HostSubnet) {
+	// Move the egress IPs of the node elsewhere
+	if ms := hs.Annotations[AnnotationEgressIPsManagedBy]; ms != "" {
+		c.invalidateAssignment(ms)
+		c.triggerReconcile(ms)
+	}
+}
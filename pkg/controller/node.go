@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+func (c *Controller) createNodeInformer() {
+	factory := informers.NewSharedInformerFactory(c.kubeClient, c.resyncPeriod)
+	informer := factory.Core().V1().Nodes()
+	if err := informer.Informer().AddIndexers(NodeIndexers); err != nil {
+		klog.Fatal(err)
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) {
+			c.enqueuePolicySync()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode := oldObj.(*corev1.Node)
+			newNode := newObj.(*corev1.Node)
+			c.UpdateNode(oldNode, newNode)
+		},
+		DeleteFunc: func(interface{}) {
+			c.enqueuePolicySync()
+		},
+	})
+
+	c.kubeInformerFactory = factory
+	c.nodeInformer = informer
+}
+
+// UpdateNode enqueues the node's HostSubnet if its Machine annotation changed,
+// as that might change which MachineSet it belongs to. Label changes might
+// change which policies select the node.
+func (c *Controller) UpdateNode(oldNode, node *corev1.Node) {
+	if oldNode.Annotations[MachineAnnotation] != node.Annotations[MachineAnnotation] {
+		// The previous MachineSet notices from the marker on the HostSubnet
+		c.invalidateAssignment(c.machineSetForNode(node.Name))
+		c.enqueue(node.Name)
+	}
+	if !reflect.DeepEqual(oldNode.Labels, node.Labels) {
+		c.enqueuePolicySync()
+	}
+}
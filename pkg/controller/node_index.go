@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	machineByNodeIndex = "machineByNode"
+	nodeByMachineIndex = "nodeByMachine"
+)
+
+var (
+	// MachineIndexers must be registered on the Machine informer for a
+	// MachineNodeIndex to work.
+	MachineIndexers = cache.Indexers{machineByNodeIndex: indexMachineByNode}
+	// NodeIndexers must be registered on the Node informer for a
+	// MachineNodeIndex to work.
+	NodeIndexers = cache.Indexers{nodeByMachineIndex: indexNodeByMachine}
+)
+
+// MachineNodeIndex resolves Machines to Nodes and vice versa. The primary
+// source is `Machine.Status.NodeRef`, with the `machine.openshift.io/machine`
+// annotation on the Node as fallback. Node and HostSubnet names are always
+// equal, Machine names are not.
+type MachineNodeIndex struct {
+	machines cache.Indexer
+	nodes    cache.Indexer
+}
+
+func NewMachineNodeIndex(machines, nodes cache.Indexer) *MachineNodeIndex {
+	return &MachineNodeIndex{
+		machines: machines,
+		nodes:    nodes,
+	}
+}
+
+// MachineForNode returns the Machine backing the Node `nodeName`. It satisfies
+// MachineGetter.
+func (i *MachineNodeIndex) MachineForNode(nodeName string) (*v1beta1.Machine, error) {
+	objs, err := i.machines.ByIndex(machineByNodeIndex, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	switch len(objs) {
+	case 0:
+	case 1:
+		return objs[0].(*v1beta1.Machine), nil
+	default:
+		return nil, fmt.Errorf("node %s is referenced by %d machines", nodeName, len(objs))
+	}
+
+	obj, exists, err := i.nodes.GetByKey(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, apierrors.NewNotFound(v1beta1.Resource("machine"), nodeName)
+	}
+
+	key := obj.(*corev1.Node).Annotations[MachineAnnotation]
+	if key == "" {
+		return nil, apierrors.NewNotFound(v1beta1.Resource("machine"), nodeName)
+	}
+
+	obj, exists, err = i.machines.GetByKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, apierrors.NewNotFound(v1beta1.Resource("machine"), key)
+	}
+	return obj.(*v1beta1.Machine), nil
+}
+
+// NodeForMachine returns the name of the Node backed by Machine `m`, or an
+// empty string if the Machine has no Node (yet).
+func (i *MachineNodeIndex) NodeForMachine(m *v1beta1.Machine) (string, error) {
+	if m.Status.NodeRef != nil && m.Status.NodeRef.Name != "" {
+		return m.Status.NodeRef.Name, nil
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(m)
+	if err != nil {
+		return "", err
+	}
+
+	names, err := i.nodes.IndexKeys(nodeByMachineIndex, key)
+	if err != nil {
+		return "", err
+	}
+	switch len(names) {
+	case 0:
+		return "", nil
+	case 1:
+		return names[0], nil
+	default:
+		return "", fmt.Errorf("machine %s is referenced by %d nodes", key, len(names))
+	}
+}
+
+func indexMachineByNode(obj interface{}) ([]string, error) {
+	m, ok := obj.(*v1beta1.Machine)
+	if !ok || m.Status.NodeRef == nil || m.Status.NodeRef.Name == "" {
+		return nil, nil
+	}
+	return []string{m.Status.NodeRef.Name}, nil
+}
+
+func indexNodeByMachine(obj interface{}) ([]string, error) {
+	n, ok := obj.(*corev1.Node)
+	if !ok || n.Annotations[MachineAnnotation] == "" {
+		return nil, nil
+	}
+	return []string{n.Annotations[MachineAnnotation]}, nil
+}
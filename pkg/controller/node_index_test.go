@@ -0,0 +1,91 @@
+package controller_test
+
+import (
+	"testing"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	"github.com/matryer/is"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestMachineNodeIndexNodeRef(t *testing.T) {
+	is := is.New(t)
+	idx, machines, _ := mockIndex()
+
+	m := mockMachine("worker-a1b2c", "worker")
+	m.Status.NodeRef = &corev1.ObjectReference{Name: "node01.example.com"}
+	is.NoErr(machines.Add(m))
+
+	got, err := idx.MachineForNode("node01.example.com")
+	is.NoErr(err)
+	is.Equal(got.Name, "worker-a1b2c")
+
+	node, err := idx.NodeForMachine(m)
+	is.NoErr(err)
+	is.Equal(node, "node01.example.com")
+}
+
+func TestMachineNodeIndexAnnotation(t *testing.T) {
+	is := is.New(t)
+	idx, machines, nodes := mockIndex()
+
+	m := mockMachine("worker-a1b2c", "worker")
+	is.NoErr(machines.Add(m))
+	is.NoErr(nodes.Add(mockNode("node01.example.com", controller.MachineNamespace+"/worker-a1b2c")))
+
+	got, err := idx.MachineForNode("node01.example.com")
+	is.NoErr(err)
+	is.Equal(got.Name, "worker-a1b2c")
+
+	node, err := idx.NodeForMachine(m)
+	is.NoErr(err)
+	is.Equal(node, "node01.example.com")
+}
+
+func TestMachineNodeIndexUnknown(t *testing.T) {
+	is := is.New(t)
+	idx, machines, nodes := mockIndex()
+
+	m := mockMachine("worker-a1b2c", "worker")
+	is.NoErr(machines.Add(m))
+	is.NoErr(nodes.Add(mockNode("node01.example.com", "")))
+
+	_, err := idx.MachineForNode("node01.example.com")
+	is.True(apierrors.IsNotFound(err))
+	_, err = idx.MachineForNode("node02.example.com")
+	is.True(apierrors.IsNotFound(err))
+
+	node, err := idx.NodeForMachine(m)
+	is.NoErr(err)
+	is.Equal(node, "")
+}
+
+func mockIndex() (*controller.MachineNodeIndex, cache.Indexer, cache.Indexer) {
+	machines := cache.NewIndexer(cache.MetaNamespaceKeyFunc, controller.MachineIndexers)
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, controller.NodeIndexers)
+	return controller.NewMachineNodeIndex(machines, nodes), machines, nodes
+}
+
+func mockMachine(name, machineset string) *v1beta1.Machine {
+	m := new(v1beta1.Machine)
+	m.SetName(name)
+	m.SetNamespace(controller.MachineNamespace)
+	m.SetLabels(map[string]string{
+		controller.MachinesetLabel: machineset,
+	})
+	return m
+}
+
+func mockNode(name, machine string) *corev1.Node {
+	n := new(corev1.Node)
+	n.SetName(name)
+	if machine != "" {
+		n.SetAnnotations(map[string]string{
+			controller.MachineAnnotation: machine,
+		})
+	}
+	return n
+}
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+
+	v1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+const FieldManager = "openshift-machineset-egress-cidr-operator"
+
+// egressObject is an object a network plugin reads its egress configuration
+// from: a HostSubnet on OpenShift SDN, a Node on OVN-Kubernetes. It provides
+// the object specific reads and patches to reconcileObject and releaseObject,
+// which are shared by all network types.
+type egressObject interface {
+	metav1.Object
+	// kind is the kind of the object, used in logs.
+	kind() string
+	// change returns the change applying the egress CIDRs `desired` to the
+	// object. `machine` may be nil.
+	change(layout Layout, machine *v1beta1.Machine, desired []v1.HostSubnetEgressCIDR) egressChange
+	// reconcileExtra applies configuration of MachineSet `machineset` beyond
+	// the egress CIDRs. Returns OutcomeUpToDate if there is none.
+	reconcileExtra(cidrs *CIDRMap, machineset string) ReconcileResult
+	// snapshot returns a Snapshot of the egress configuration, TakenAt is set
+	// by the caller.
+	snapshot() Snapshot
+	// state describes the egress configuration, e.g. "egressCIDRs [192.0.2.0/24]".
+	state() string
+	// clear adds removing the egress configuration to `patch` and describes
+	// the change.
+	clear(patch *objectPatch) string
+	// restore adds restoring the egress configuration from `s` to `patch` and
+	// describes the change. Fails if `s` was not taken from this kind.
+	restore(s Snapshot, patch *objectPatch) (string, error)
+	// send applies `patch` to the object.
+	send(patch objectPatch) error
+	// record records an event on the object and, if `machineSet` is not
+	// empty, on the MachineSet with that name.
+	record(machineSet, eventtype, reason, messageFmt string, args ...interface{})
+}
+
+// egressChange is returned by egressObject.change.
+type egressChange struct {
+	// upToDate is true if the object already has the desired configuration.
+	upToDate bool
+	// patch applies the desired configuration, without the marker annotations.
+	patch objectPatch
+	// what describes the desired configuration for logs and events, e.g.
+	// "egressCIDRs to [192.0.2.0/24] (was [])".
+	what string
+	// done describes the applied change for events.
+	done string
+	// warnings are recorded with ReasonUnreachableCIDR after the change was
+	// applied.
+	warnings []string
+	// note is appended to the reason of the ReconcileResult.
+	note string
+}
+
+// objectPatch describes the fields of a HostSubnet or Node to change. Only
+// these fields are sent, so concurrent changes to other fields are left alone.
+type objectPatch struct {
+	// EgressCIDRs of a HostSubnet are left alone if nil.
+	EgressCIDRs []v1.HostSubnetEgressCIDR
+	// EgressIPs of a HostSubnet are left alone if nil.
+	EgressIPs []v1.HostSubnetEgressIP
+	// Labels with a nil value are removed.
+	Labels map[string]*string
+	// Annotations with a nil value are removed.
+	Annotations map[string]*string
+}
+
+// MarshalJSON renders the patch as a JSON merge patch.
+func (p objectPatch) MarshalJSON() ([]byte, error) {
+	patch := make(map[string]interface{})
+	if p.EgressCIDRs != nil {
+		patch["egressCIDRs"] = p.EgressCIDRs
+	}
+	if p.EgressIPs != nil {
+		patch["egressIPs"] = p.EgressIPs
+	}
+	metadata := make(map[string]interface{})
+	if len(p.Labels) > 0 {
+		metadata["labels"] = p.Labels
+	}
+	if len(p.Annotations) > 0 {
+		metadata["annotations"] = p.Annotations
+	}
+	if len(metadata) > 0 {
+		patch["metadata"] = metadata
+	}
+	return json.Marshal(patch)
+}
+
+// objectPatcher is the untyped signature of HostSubnetPatcher and NodePatcher.
+type objectPatcher func(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions) error
+
+// applyPatch sends `patch` to the object `name` as a JSON merge patch.
+// Conflicts are retried.
+func applyPatch(ctx context.Context, send objectPatcher, name string, patch objectPatch) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		return send(ctx, name, types.MergePatchType, data, metav1.PatchOptions{
+			FieldManager: FieldManager,
+		})
+	})
+}
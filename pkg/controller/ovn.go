@@ -0,0 +1,270 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	v1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// LabelEgressAssignable marks a node as eligible to host egress IPs on
+	// OVN-Kubernetes.
+	LabelEgressAssignable = "k8s.ovn.org/egress-assignable"
+	// AnnotationPrimaryIfAddr holds the address and prefix of the primary
+	// interface of a node, set by OVN-Kubernetes.
+	AnnotationPrimaryIfAddr = "k8s.ovn.org/node-primary-ifaddr"
+	// AnnotationEgressIPConfig holds the egress IP subnets and capacity of a
+	// node on clouds, set by the cloud-network-config-controller.
+	AnnotationEgressIPConfig = "cloud.network.openshift.io/egress-ipconfig"
+)
+
+// NodePatcher has the signature of NodeInterface.Patch.
+type NodePatcher func(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*corev1.Node, error)
+
+func (f NodePatcher) untyped() objectPatcher {
+	return func(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions) error {
+		_, err := f(ctx, name, pt, data, opts)
+		return err
+	}
+}
+
+// NodeRecorder records an event on `node` and, if `machineSet` is not empty,
+// the same event on the MachineSet with that name.
+type NodeRecorder func(node *corev1.Node, machineSet, eventtype, reason, messageFmt string, args ...interface{})
+
+// ReconcileNode sets the LabelEgressAssignable of `node` if the CIDRs
+// configured for the MachineSet of the node are on one of its egress subnets.
+// It is the OVN-Kubernetes counterpart of ReconcileSubnet, which assigns
+// egress IPs to all labelled nodes on the right subnet by itself.
+func ReconcileNode(
+	layout Layout,
+	node *corev1.Node,
+	cidrs *CIDRMap,
+	getMachine MachineGetter,
+	patchNode NodePatcher,
+	recordEvent NodeRecorder,
+) ReconcileResult {
+	return reconcileObject(layout, nodeObject{node, patchNode, recordEvent}, cidrs, getMachine)
+}
+
+// ReleaseNode removes the marker annotations from a no longer managed node and
+// applies `policy` to its LabelEgressAssignable.
+func ReleaseNode(
+	node *corev1.Node,
+	policy ReleasePolicy,
+	reason, machineset string,
+	patchNode NodePatcher,
+	recordEvent NodeRecorder,
+) ReconcileResult {
+	return applyRelease(nodeObject{node, patchNode, recordEvent}, policy, reason, machineset)
+}
+
+// nodeObject adapts a Node to egressObject.
+type nodeObject struct {
+	*corev1.Node
+	patchNode   NodePatcher
+	recordEvent NodeRecorder
+}
+
+func (o nodeObject) kind() string { return "Node" }
+
+// change sets or removes the LabelEgressAssignable according to `desired`.
+func (o nodeObject) change(_ Layout, _ *v1beta1.Machine, desired []v1.HostSubnetEgressCIDR) egressChange {
+	assignable, unreachable, err := egressAssignable(o.Node, desired)
+	if err != nil {
+		klog.Warningf("Node<%s>: not egress assignable: %s", o.Name, err)
+	}
+	_, actual := o.Labels[LabelEgressAssignable]
+
+	change := egressChange{
+		upToDate: actual == assignable,
+		what:     fmt.Sprintf("%s=%t", LabelEgressAssignable, assignable),
+		done:     fmt.Sprintf("Removed label %s for egressCIDRs %v", LabelEgressAssignable, desired),
+	}
+	if assignable {
+		change.done = fmt.Sprintf("Set label %s for egressCIDRs %v", LabelEgressAssignable, desired)
+	}
+	if actual != assignable {
+		change.patch.Labels = egressAssignableLabel(assignable)
+	}
+	if err != nil {
+		change.warnings = []string{fmt.Sprintf("Node is not egress assignable: %s", err)}
+	} else if len(unreachable) > 0 {
+		change.warnings = []string{fmt.Sprintf("egressCIDRs %v are not on an egress subnet of the node", unreachable)}
+	}
+	return change
+}
+
+func (o nodeObject) reconcileExtra(_ *CIDRMap, machineset string) ReconcileResult {
+	return ReconcileResult{Outcome: OutcomeUpToDate, MachineSet: machineset}
+}
+
+func (o nodeObject) snapshot() Snapshot {
+	_, labelled := o.Labels[LabelEgressAssignable]
+	return Snapshot{EgressAssignable: &labelled}
+}
+
+func (o nodeObject) state() string {
+	_, labelled := o.Labels[LabelEgressAssignable]
+	return fmt.Sprintf("%s=%t", LabelEgressAssignable, labelled)
+}
+
+func (o nodeObject) clear(patch *objectPatch) string {
+	patch.Labels = egressAssignableLabel(false)
+	return fmt.Sprintf("removed label %s", LabelEgressAssignable)
+}
+
+func (o nodeObject) restore(s Snapshot, patch *objectPatch) (string, error) {
+	if s.EgressAssignable == nil {
+		return "", errors.New("snapshot was taken from a HostSubnet")
+	}
+	_, labelled := o.Labels[LabelEgressAssignable]
+	patch.Labels = egressAssignableLabel(*s.EgressAssignable)
+	return fmt.Sprintf("restored %s=%t from %s (was %t)",
+		LabelEgressAssignable, *s.EgressAssignable, formatTakenAt(s), labelled), nil
+}
+
+func (o nodeObject) send(patch objectPatch) error {
+	return applyPatch(context.Background(), o.patchNode.untyped(), o.Name, patch)
+}
+
+func (o nodeObject) record(machineSet, eventtype, reason, messageFmt string, args ...interface{}) {
+	o.recordEvent(o.Node, machineSet, eventtype, reason, messageFmt, args...)
+}
+
+// egressAssignableLabel returns the labels patch setting or removing the
+// LabelEgressAssignable.
+func egressAssignableLabel(assignable bool) map[string]*string {
+	labels := map[string]*string{LabelEgressAssignable: nil}
+	if assignable {
+		labels[LabelEgressAssignable] = new(string)
+	}
+	return labels
+}
+
+// egressAssignable returns true if at least one of `cidrs` is on an egress
+// subnet of `node` which can host egress IPs at all, along with the CIDRs which
+// are not. The capacity of a subnet is the total number of egress IPs the node
+// can host on it, so only subnets with a capacity of 0 are skipped. The error
+// explains why a node with CIDRs is not assignable.
+func egressAssignable(node *corev1.Node, cidrs []v1.HostSubnetEgressCIDR) (bool, []v1.HostSubnetEgressCIDR, error) {
+	if len(cidrs) == 0 || len(cidrs) == 1 && cidrs[0] == "none" {
+		return false, nil, nil
+	}
+
+	subnets, err := EgressSubnetsOf(node)
+	if err != nil {
+		return false, cidrs, err
+	}
+	reachable := make([]v1.HostSubnetEgressCIDR, 0, len(cidrs))
+	unreachable := make([]v1.HostSubnetEgressCIDR, 0)
+	for _, subnet := range subnets {
+		if subnet.Capacity == 0 {
+			continue
+		}
+		prefix, _ := subnet.CIDR.Mask.Size()
+		r, _ := reachableCIDRs(cidrs, []net.IP{subnet.CIDR.IP}, prefix)
+		reachable = append(reachable, r...)
+	}
+	for _, cidr := range cidrs {
+		if !containsCIDR(reachable, cidr) {
+			unreachable = append(unreachable, cidr)
+		}
+	}
+	if len(reachable) == 0 {
+		return false, unreachable, fmt.Errorf("none of %v is on an egress subnet with a capacity above 0 %v", cidrs, subnets)
+	}
+	return true, unreachable, nil
+}
+
+func containsCIDR(cidrs []v1.HostSubnetEgressCIDR, cidr v1.HostSubnetEgressCIDR) bool {
+	for _, c := range cidrs {
+		if c == cidr {
+			return true
+		}
+	}
+	return false
+}
+
+// EgressSubnet is an IPv4 subnet a node can host egress IPs on.
+type EgressSubnet struct {
+	CIDR *net.IPNet
+	// Capacity is the number of egress IPs the node can host, -1 if unknown.
+	Capacity int
+}
+
+func (s EgressSubnet) String() string {
+	if s.Capacity < 0 {
+		return s.CIDR.String()
+	}
+	return fmt.Sprintf("%s (capacity %d)", s.CIDR, s.Capacity)
+}
+
+// egressIPConfig is an entry of AnnotationEgressIPConfig.
+type egressIPConfig struct {
+	IFAddr struct {
+		IPv4 string `json:"ipv4"`
+	} `json:"ifaddr"`
+	Capacity struct {
+		IPv4 *int `json:"ipv4"`
+		// IP is the capacity shared by IPv4 and IPv6 on some clouds
+		IP *int `json:"ip"`
+	} `json:"capacity"`
+}
+
+// EgressSubnetsOf returns the egress subnets of `node` from its
+// AnnotationEgressIPConfig on clouds, or its AnnotationPrimaryIfAddr.
+func EgressSubnetsOf(node *corev1.Node) ([]EgressSubnet, error) {
+	if v, ok := node.Annotations[AnnotationEgressIPConfig]; ok {
+		var configs []egressIPConfig
+		if err := json.Unmarshal([]byte(v), &configs); err != nil {
+			return nil, fmt.Errorf("invalid annotation %s: %w", AnnotationEgressIPConfig, err)
+		}
+		subnets := make([]EgressSubnet, 0, len(configs))
+		for _, config := range configs {
+			if config.IFAddr.IPv4 == "" {
+				continue
+			}
+			_, ipnet, err := net.ParseCIDR(config.IFAddr.IPv4)
+			if err != nil {
+				return nil, fmt.Errorf("invalid annotation %s: %w", AnnotationEgressIPConfig, err)
+			}
+			subnet := EgressSubnet{CIDR: ipnet, Capacity: -1}
+			if config.Capacity.IPv4 != nil {
+				subnet.Capacity = *config.Capacity.IPv4
+			} else if config.Capacity.IP != nil {
+				subnet.Capacity = *config.Capacity.IP
+			}
+			subnets = append(subnets, subnet)
+		}
+		return subnets, nil
+	}
+
+	if v, ok := node.Annotations[AnnotationPrimaryIfAddr]; ok {
+		var ifaddr struct {
+			IPv4 string `json:"ipv4"`
+		}
+		if err := json.Unmarshal([]byte(v), &ifaddr); err != nil {
+			return nil, fmt.Errorf("invalid annotation %s: %w", AnnotationPrimaryIfAddr, err)
+		}
+		if ifaddr.IPv4 == "" {
+			return nil, fmt.Errorf("no IPv4 address in annotation %s", AnnotationPrimaryIfAddr)
+		}
+		_, ipnet, err := net.ParseCIDR(ifaddr.IPv4)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation %s: %w", AnnotationPrimaryIfAddr, err)
+		}
+		return []EgressSubnet{{CIDR: ipnet, Capacity: -1}}, nil
+	}
+
+	return nil, fmt.Errorf("neither annotation %s nor %s set", AnnotationEgressIPConfig, AnnotationPrimaryIfAddr)
+}
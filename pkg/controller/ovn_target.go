@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+
+	v1 "github.com/openshift/api/network/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// ovnTarget manages the LabelEgressAssignable of nodes.
+type ovnTarget struct {
+	c *Controller
+}
+
+func (c *Controller) newOVNTarget() ovnTarget {
+	c.nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.enqueue(obj.(*corev1.Node).Name)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode := oldObj.(*corev1.Node)
+			node := newObj.(*corev1.Node)
+			// Ignore status updates, which happen every few seconds
+			if !reflect.DeepEqual(oldNode.Labels, node.Labels) || !reflect.DeepEqual(oldNode.Annotations, node.Annotations) {
+				c.enqueue(node.Name)
+			}
+		},
+	})
+	return ovnTarget{c}
+}
+
+func (t ovnTarget) start(context.Context) bool {
+	// The node informer is started and synced before any target
+	return true
+}
+
+func (t ovnTarget) nodes() ([]string, error) {
+	nodes, err := t.c.nodeInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(nodes))
+	for i, node := range nodes {
+		names[i] = node.Name
+	}
+	return names, nil
+}
+
+func (t ovnTarget) reconcile(ctx context.Context, current settings, name string) ReconcileResult {
+	node, err := t.c.nodeInformer.Lister().Get(name)
+	if apierrors.IsNotFound(err) {
+		klog.V(8).Infof("Node<%s>: gone, skipping", name)
+		return ReconcileResult{Outcome: OutcomeSkipped, Reason: "node gone"}
+	}
+	if err != nil {
+		return ReconcileResult{Outcome: OutcomeError, Reason: "get node", Requeue: true, Err: err}
+	}
+
+	return ReconcileNode(current.layout, node, t.c.cidrs, t.c.index.MachineForNode, t.c.nodePatcher(ctx, current.dryRun), t.c.recordNodeEvent)
+}
+
+func (t ovnTarget) inSync(_ Layout, name string, desired []v1.HostSubnetEgressCIDR) bool {
+	node, err := t.c.nodeInformer.Lister().Get(name)
+	if err != nil {
+		return false
+	}
+	assignable, _, _ := egressAssignable(node, desired)
+	_, labelled := node.Labels[LabelEgressAssignable]
+	return labelled == assignable
+}
+
+// recordNodeEvent satisfies NodeRecorder.
+func (c *Controller) recordNodeEvent(node *corev1.Node, machineSet, eventtype, reason, messageFmt string, args ...interface{}) {
+	c.recordObjectEvent(node, "Node "+node.Name, machineSet, eventtype, reason, messageFmt, args...)
+}
@@ -0,0 +1,194 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	"github.com/matryer/is"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestEgressSubnetsOf(t *testing.T) {
+	for _, c := range []struct {
+		Name        string
+		Annotations map[string]string
+		Expected    []string
+		Err         bool
+	}{
+		{"primary-ifaddr", map[string]string{
+			controller.AnnotationPrimaryIfAddr: `{"ipv4":"192.0.2.10/24"}`,
+		}, []string{"192.0.2.0/24"}, false},
+		{"egress-ipconfig", map[string]string{
+			controller.AnnotationPrimaryIfAddr:  `{"ipv4":"192.0.2.10/24"}`,
+			controller.AnnotationEgressIPConfig: `[{"interface":"eni-1","ifaddr":{"ipv4":"198.51.100.0/25"},"capacity":{"ipv4":14}}]`,
+		}, []string{"198.51.100.0/25 (capacity 14)"}, false},
+		{"shared-capacity", map[string]string{
+			controller.AnnotationEgressIPConfig: `[{"interface":"nic0","ifaddr":{"ipv4":"198.51.100.0/25"},"capacity":{"ip":10}}]`,
+		}, []string{"198.51.100.0/25 (capacity 10)"}, false},
+		{"ipv6-only", map[string]string{
+			controller.AnnotationPrimaryIfAddr: `{"ipv6":"2001:db8::10/64"}`,
+		}, nil, true},
+		{"invalid", map[string]string{
+			controller.AnnotationPrimaryIfAddr: `192.0.2.10/24`,
+		}, nil, true},
+		{"missing", nil, nil, true},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			is := is.New(t)
+			node := mockNode("node01", "")
+			node.SetAnnotations(c.Annotations)
+
+			subnets, err := controller.EgressSubnetsOf(node)
+			is.Equal(err != nil, c.Err)
+			is.Equal(len(subnets), len(c.Expected))
+			for i := range c.Expected {
+				is.Equal(subnets[i].String(), c.Expected[i])
+			}
+		})
+	}
+}
+
+func TestReconcileNodeAssignable(t *testing.T) {
+	is := is.New(t)
+	node := mockOVNNode("node123", `{"ipv4":"192.0.2.10/24"}`)
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.Set("some", "192.0.2.128/27,203.0.113.0/24"))
+	getMachine, _ := mockGetMachine(t, "some", node.Name)
+	patchNode, patches := captureNodePatches()
+	recordEvent, events := mockNodeRecorder()
+
+	res := controller.ReconcileNode(controller.DefaultLayout(), node, cm, getMachine, patchNode, recordEvent)
+	is.Equal(res.Outcome, controller.OutcomeUpdated)
+	is.Equal(*events, []string{"some Normal EgressCIDRsUpdated", "some Warning EgressCIDRUnreachable"})
+
+	patched := decodeNodePatch(t, *patches)
+	is.Equal(patched.Labels, map[string]string{controller.LabelEgressAssignable: ""})
+	is.Equal(patched.Annotations[controller.AnnotationManagedBy], "some")
+	var snapshot controller.Snapshot
+	is.NoErr(json.Unmarshal([]byte(patched.Annotations[controller.AnnotationOriginal]), &snapshot))
+	is.Equal(*snapshot.EgressAssignable, false)
+
+	// Up to date once labelled and marked
+	node.Labels = patched.Labels
+	for k, v := range patched.Annotations {
+		node.Annotations[k] = v
+	}
+	res = controller.ReconcileNode(controller.DefaultLayout(), node, cm, getMachine, patchNode, recordEvent)
+	is.Equal(res.Outcome, controller.OutcomeUpToDate)
+	is.Equal(len(*patches), 1)
+}
+
+func TestReconcileNodeUnreachable(t *testing.T) {
+	is := is.New(t)
+	node := mockOVNNode("node123", `{"ipv4":"192.0.2.10/24"}`)
+	node.Labels = map[string]string{controller.LabelEgressAssignable: ""}
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.Set("some", "203.0.113.0/24"))
+	getMachine, _ := mockGetMachine(t, "some", node.Name)
+	patchNode, patches := captureNodePatches()
+
+	res := controller.ReconcileNode(controller.DefaultLayout(), node, cm, getMachine, patchNode, discardNodeEvents)
+	is.Equal(res.Outcome, controller.OutcomeUpdated)
+	is.Equal(len(*patches), 1)
+	is.Equal((*patches)[0]["metadata"]["labels"], map[string]interface{}{controller.LabelEgressAssignable: nil})
+}
+
+func TestReconcileNodeNoCapacity(t *testing.T) {
+	is := is.New(t)
+	node := mockOVNNode("node123", "")
+	node.Annotations[controller.AnnotationEgressIPConfig] = `[{"interface":"eni-1","ifaddr":{"ipv4":"192.0.2.0/24"},"capacity":{"ipv4":0}}]`
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.Set("some", "192.0.2.128/27"))
+	getMachine, _ := mockGetMachine(t, "some", node.Name)
+	patchNode, patches := captureNodePatches()
+
+	res := controller.ReconcileNode(controller.DefaultLayout(), node, cm, getMachine, patchNode, discardNodeEvents)
+	is.Equal(res.Outcome, controller.OutcomeUpdated) // marked as managed
+	is.Equal(len(*patches), 1)
+	is.Equal((*patches)[0]["metadata"]["labels"], nil)
+}
+
+func TestReleaseNodeRestore(t *testing.T) {
+	is := is.New(t)
+	node := mockOVNNode("node123", "")
+	node.Labels = map[string]string{controller.LabelEgressAssignable: ""}
+	node.Annotations[controller.AnnotationManagedBy] = "some"
+	node.Annotations[controller.AnnotationOnRelease] = string(controller.ReleaseRestore)
+	node.Annotations[controller.AnnotationOriginal] = `{"egressAssignable":false,"takenAt":"2021-06-01T00:00:00Z"}`
+	cm := controller.NewCIDRMap()
+	getMachine, _ := mockGetMachine(t, "some", node.Name)
+	patchNode, patches := captureNodePatches()
+	recordEvent, events := mockNodeRecorder()
+
+	res := controller.ReconcileNode(controller.DefaultLayout(), node, cm, getMachine, patchNode, recordEvent)
+	is.Equal(res.Outcome, controller.OutcomeReleased)
+	is.Equal(*events, []string{"some Normal EgressCIDRsReleased"})
+	is.Equal((*patches)[0]["metadata"]["labels"], map[string]interface{}{controller.LabelEgressAssignable: nil})
+	is.Equal((*patches)[0]["metadata"]["annotations"], map[string]interface{}{
+		controller.AnnotationManagedBy: nil,
+		controller.AnnotationOnRelease: nil,
+		controller.AnnotationOriginal:  nil,
+	})
+
+	// snapshots of HostSubnets are not restored on nodes
+	node.Annotations[controller.AnnotationOriginal] = `{"egressCIDRs":["192.0.2.0/24"],"takenAt":"2021-06-01T00:00:00Z"}`
+	*events = nil
+	res = controller.ReconcileNode(controller.DefaultLayout(), node, cm, getMachine, patchNode, recordEvent)
+	is.Equal(res.Outcome, controller.OutcomeReleased)
+	is.Equal(*events, []string{"some Warning EgressCIDRsRestoreFailed", "some Normal EgressCIDRsReleased"})
+	is.Equal((*patches)[1]["metadata"]["labels"], nil) // label kept
+}
+
+func mockOVNNode(name, ifaddr string) *corev1.Node {
+	node := mockNode(name, "")
+	node.Annotations = map[string]string{}
+	if ifaddr != "" {
+		node.Annotations[controller.AnnotationPrimaryIfAddr] = ifaddr
+	}
+	return node
+}
+
+// captureNodePatches returns a NodePatcher which records the decoded patches.
+func captureNodePatches() (controller.NodePatcher, *[]map[string]map[string]interface{}) {
+	patches := new([]map[string]map[string]interface{})
+
+	fn := func(_ context.Context, name string, _ types.PatchType, data []byte, _ metav1.PatchOptions, _ ...string) (*corev1.Node, error) {
+		patch := make(map[string]map[string]interface{})
+		if err := json.Unmarshal(data, &patch); err != nil {
+			return nil, err
+		}
+		*patches = append(*patches, patch)
+		return nil, nil
+	}
+
+	return fn, patches
+}
+
+// decodeNodePatch returns the labels and annotations set by the last patch.
+func decodeNodePatch(t *testing.T, patches []map[string]map[string]interface{}) *corev1.Node {
+	is := is.New(t)
+	is.True(len(patches) > 0)
+	data, err := json.Marshal(patches[len(patches)-1])
+	is.NoErr(err)
+	node := new(corev1.Node)
+	is.NoErr(json.Unmarshal(data, node))
+	return node
+}
+
+func discardNodeEvents(*corev1.Node, string, string, string, string, ...interface{}) {}
+
+// mockNodeRecorder returns a NodeRecorder which records events as
+// "<machineset> <type> <reason>".
+func mockNodeRecorder() (controller.NodeRecorder, *[]string) {
+	events := new([]string)
+
+	fn := func(node *corev1.Node, machineSet, eventtype, reason, messageFmt string, args ...interface{}) {
+		*events = append(*events, machineSet+" "+eventtype+" "+reason)
+	}
+
+	return fn, events
+}
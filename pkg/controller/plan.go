@@ -0,0 +1,194 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/apis/egress/v1alpha1"
+	v1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// PlanEntry is the change ReconcileSubnet would make to a single HostSubnet.
+type PlanEntry struct {
+	Node       string  `json:"node"`
+	MachineSet string  `json:"machineSet,omitempty"`
+	Outcome    Outcome `json:"outcome"`
+	Reason     string  `json:"reason"`
+	Error      string  `json:"error,omitempty"`
+	// Pending is true if the HostSubnet would be patched.
+	Pending bool                      `json:"pending"`
+	Actual  []v1.HostSubnetEgressCIDR `json:"actual"`
+	Desired []v1.HostSubnetEgressCIDR `json:"desired"`
+	// ActualIPs and DesiredIPs are the egressIPs, if managed.
+	ActualIPs  []v1.HostSubnetEgressIP `json:"actualEgressIPs,omitempty"`
+	DesiredIPs []v1.HostSubnetEgressIP `json:"desiredEgressIPs,omitempty"`
+}
+
+// BuildCIDRMap computes the CIDRMap the controller configured with `opts`
+// would build from the given MachineSets and EgressCIDRPolicies. Invalid
+// annotations, collisions with the `reserved` networks and overlaps are
+// returned as errors. Invalid and colliding annotations, and with
+// StrictOverlaps overlapping annotations and policy entries, are left out of
+// the map.
+func BuildCIDRMap(
+	opts Options,
+	reserved []ReservedNetwork,
+	machineSets []*v1beta1.MachineSet,
+	policies []*v1alpha1.EgressCIDRPolicy,
+	nodes []*corev1.Node,
+) (*CIDRMap, []error) {
+	layout, defaultRelease := opts.Layout, opts.DefaultReleasePolicy
+	cidrs := NewCIDRMap()
+	cidrs.SetReserved(reserved)
+	var errs []error
+
+	for _, ms := range machineSets {
+		v := layout.EgressCIDRsOf(ms)
+		if v == "" {
+			continue
+		}
+		if overlaps := cidrs.Overlapping(ms.Name, v); len(overlaps) > 0 {
+			errs = append(errs, fmt.Errorf("MachineSet %s: %s", ms.Name, joinOverlaps(overlaps)))
+			if opts.StrictOverlaps {
+				continue
+			}
+		}
+		if err := cidrs.Set(ms.Name, v); err != nil {
+			errs = append(errs, fmt.Errorf("MachineSet %s: %w", ms.Name, err))
+			continue
+		}
+		release, err := releasePolicyOf(ms, defaultRelease)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MachineSet %s: %w", ms.Name, err))
+		}
+		cidrs.SetReleasePolicy(ms.Name, release)
+	}
+
+	entries, results := ResolvePolicies(layout, reserved, policies, machineSets, nodes)
+	owners := policyOwners(results)
+	for _, key := range sortedEntryKeys(entries) {
+		v := entries[key]
+		if overlaps := policyOverlaps(cidrs, key, v, owners); len(overlaps) > 0 {
+			errs = append(errs, fmt.Errorf("EgressCIDRPolicy %s: %s", owners[key], joinOverlaps(overlaps)))
+			if opts.StrictOverlaps {
+				continue
+			}
+		}
+		// Validated by ResolvePolicies
+		_ = cidrs.Set(key, v)
+		cidrs.SetReleasePolicy(key, defaultRelease)
+	}
+
+	// Egress IPs after all CIDRs, so IPs within them are reported
+	for _, ms := range machineSets {
+		ips := layout.EgressIPsOf(ms)
+		if ips == "" {
+			continue
+		}
+		if layout.EgressCIDRsOf(ms) != "" {
+			errs = append(errs, fmt.Errorf("MachineSet %s: annotation %s ignored, cannot be combined with %s",
+				ms.Name, layout.EgressIPsAnnotation, layout.EgressCIDRsAnnotation))
+			continue
+		}
+		if err := cidrs.SetIPs(ms.Name, ips); err != nil {
+			errs = append(errs, fmt.Errorf("MachineSet %s: %w", ms.Name, err))
+		}
+	}
+
+	for name, res := range results {
+		if res.Err != nil {
+			errs = append(errs, fmt.Errorf("EgressCIDRPolicy %s: %w", name, res.Err))
+		}
+	}
+
+	return cidrs, errs
+}
+
+// Plan runs ReconcileSubnet for each HostSubnet without changing anything and
+// returns the result sorted by node name. The egress IPs in `cidrs` are
+// assigned to the HostSubnets first.
+func Plan(layout Layout, hostSubnets []*v1.HostSubnet, cidrs *CIDRMap, getMachine MachineGetter) []PlanEntry {
+	planEgressIPs(layout, hostSubnets, cidrs, getMachine)
+
+	plan := make([]PlanEntry, 0, len(hostSubnets))
+	for _, hs := range hostSubnets {
+		entry := PlanEntry{
+			Node:    hs.Name,
+			Actual:  hs.EgressCIDRs,
+			Desired: hs.EgressCIDRs,
+		}
+		if hs.Annotations[AnnotationEgressIPsManagedBy] != "" {
+			entry.ActualIPs, entry.DesiredIPs = hs.EgressIPs, hs.EgressIPs
+		}
+
+		patch := func(_ context.Context, _ string, _ types.PatchType, data []byte, _ metav1.PatchOptions, _ ...string) (*v1.HostSubnet, error) {
+			patched := new(v1.HostSubnet)
+			if err := json.Unmarshal(data, patched); err != nil {
+				return nil, err
+			}
+			entry.Pending = true
+			if patched.EgressCIDRs != nil {
+				entry.Desired = patched.EgressCIDRs
+			}
+			if patched.EgressIPs != nil {
+				entry.ActualIPs, entry.DesiredIPs = hs.EgressIPs, patched.EgressIPs
+			}
+			return nil, nil
+		}
+
+		res := ReconcileSubnet(layout, hs, cidrs, getMachine, patch, discardEvent)
+		entry.MachineSet = res.MachineSet
+		entry.Outcome = res.Outcome
+		entry.Reason = res.Reason
+		if res.Err != nil {
+			entry.Error = res.Err.Error()
+		}
+		plan = append(plan, entry)
+	}
+
+	sort.Slice(plan, func(i, j int) bool {
+		return plan[i].Node < plan[j].Node
+	})
+	return plan
+}
+
+// planEgressIPs assigns the egress IPs of each MachineSet across its
+// `hostSubnets`, starting from the egressIPs they have. Unreachable IPs are
+// left out, as the controller does.
+func planEgressIPs(layout Layout, hostSubnets []*v1.HostSubnet, cidrs *CIDRMap, getMachine MachineGetter) {
+	nodes := make(map[string]map[string][]net.IP)
+	current := make(map[string]map[string][]v1.HostSubnetEgressIP)
+	for _, hs := range hostSubnets {
+		m, err := getMachine(hs.Name)
+		if err != nil || !egressIPMember(layout, m) {
+			continue
+		}
+		ms := layout.MachineSetOf(m)
+		if nodes[ms] == nil {
+			nodes[ms] = make(map[string][]net.IP)
+		}
+		nodes[ms][hs.Name] = nodeIPs(hs, m)
+		if hs.Annotations[AnnotationEgressIPsManagedBy] == ms {
+			if current[ms] == nil {
+				current[ms] = make(map[string][]v1.HostSubnetEgressIP)
+			}
+			current[ms][hs.Name] = hs.EgressIPs
+		}
+	}
+	for ms, members := range nodes {
+		if cidrs.HasIPs(ms) {
+			assignment, _ := AssignEgressIPsOnSubnets(cidrs.IPs(ms), members, layout.NodeSubnetPrefix, current[ms])
+			cidrs.SetAssignment(ms, assignment)
+		}
+	}
+}
+
+// discardEvent is a Recorder which drops all events.
+func discardEvent(*v1.HostSubnet, string, string, string, string, ...interface{}) {}
@@ -0,0 +1,163 @@
+package controller_test
+
+import (
+	"testing"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/apis/egress/v1alpha1"
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	"github.com/matryer/is"
+	v1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBuildCIDRMap(t *testing.T) {
+	is := is.New(t)
+	restore := mockMachineSet("restore", nil, "192.0.2.0/24")
+	restore.Annotations[controller.AnnotationOnRelease] = "restore"
+	machineSets := []*v1beta1.MachineSet{
+		restore,
+		mockMachineSet("invalid", nil, "192.0.2.0/33"),
+		mockMachineSet("plain", nil, ""),
+	}
+
+	cidrs, errs := controller.BuildCIDRMap(mockOptions(controller.ReleaseKeep), nil, machineSets, nil, nil)
+	is.Equal(len(errs), 1) // invalid annotation
+	is.True(cidrs.Exists("restore"))
+	is.Equal(cidrs.ReleasePolicy("restore"), controller.ReleaseRestore)
+	is.True(!cidrs.Exists("invalid"))
+	is.True(!cidrs.Exists("plain"))
+}
+
+func TestBuildCIDRMapOverlaps(t *testing.T) {
+	is := is.New(t)
+	machineSets := []*v1beta1.MachineSet{
+		mockMachineSet("a", nil, "192.0.2.0/24"),
+		mockMachineSet("b", nil, "192.0.2.128/25"),
+	}
+
+	opts := mockOptions(controller.ReleaseKeep)
+	cidrs, errs := controller.BuildCIDRMap(opts, nil, machineSets, nil, nil)
+	is.Equal(len(errs), 1) // overlap is reported
+	is.True(cidrs.Exists("b"))
+
+	opts.StrictOverlaps = true
+	cidrs, errs = controller.BuildCIDRMap(opts, nil, machineSets, nil, nil)
+	is.Equal(len(errs), 1)
+	is.True(cidrs.Exists("a"))
+	is.True(!cidrs.Exists("b")) // refused
+}
+
+func TestBuildCIDRMapPolicyOverlaps(t *testing.T) {
+	is := is.New(t)
+	machineSets := []*v1beta1.MachineSet{
+		mockMachineSet("a", nil, "192.0.2.0/24"),
+	}
+	p := mockPolicy("policy", 0, "192.0.2.128/25")
+	p.Spec.NodeSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"egress": "true"}}
+	nodes := []*corev1.Node{mockNode("node01", ""), mockNode("node02", "")}
+	for _, node := range nodes {
+		node.Labels = map[string]string{"egress": "true"}
+	}
+	policies := []*v1alpha1.EgressCIDRPolicy{p}
+
+	opts := mockOptions(controller.ReleaseKeep)
+	cidrs, errs := controller.BuildCIDRMap(opts, nil, machineSets, policies, nodes)
+	is.Equal(len(errs), 2) // one per node, nodes of the same policy don't overlap
+	is.True(cidrs.Exists(controller.NodeKey("node01")))
+
+	opts.StrictOverlaps = true
+	cidrs, errs = controller.BuildCIDRMap(opts, nil, machineSets, policies, nodes)
+	is.Equal(len(errs), 2)
+	is.True(cidrs.Exists("a"))
+	is.True(!cidrs.Exists(controller.NodeKey("node01"))) // refused
+	is.True(!cidrs.Exists(controller.NodeKey("node02"))) // refused
+}
+
+func TestBuildCIDRMapEgressIPs(t *testing.T) {
+	is := is.New(t)
+	both := mockMachineSet("both", nil, "192.0.2.0/24")
+	both.Annotations[controller.AnnotationEgressIPs] = "198.51.100.10"
+	within := mockMachineSet("within", nil, "")
+	within.SetAnnotations(map[string]string{controller.AnnotationEgressIPs: "192.0.2.10"})
+	ips := mockMachineSet("ips", nil, "")
+	ips.SetAnnotations(map[string]string{controller.AnnotationEgressIPs: "198.51.100.10"})
+
+	cidrs, errs := controller.BuildCIDRMap(mockOptions(controller.ReleaseKeep), nil,
+		[]*v1beta1.MachineSet{both, within, ips}, nil, nil)
+	is.Equal(len(errs), 2) // both annotations, IP within the CIDRs of both
+	is.True(cidrs.Exists("both"))
+	is.True(!cidrs.HasIPs("both"))
+	is.True(!cidrs.HasIPs("within"))
+	is.Equal(cidrs.IPs("ips"), []v1.HostSubnetEgressIP{"198.51.100.10"})
+}
+
+func TestBuildCIDRMapPolicies(t *testing.T) {
+	is := is.New(t)
+	p := mockPolicy("policy", 0, "203.0.113.0/24")
+	p.Spec.NodeSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"egress": "true"}}
+	node := mockNode("node01", "")
+	node.Labels = map[string]string{"egress": "true"}
+
+	cidrs, errs := controller.BuildCIDRMap(mockOptions(controller.ReleaseClear), nil, nil, []*v1alpha1.EgressCIDRPolicy{p}, []*corev1.Node{node})
+	is.Equal(len(errs), 0)
+	is.Equal(cidrs.Get(controller.NodeKey("node01")), []v1.HostSubnetEgressCIDR{"203.0.113.0/24"})
+	is.Equal(cidrs.ReleasePolicy(controller.NodeKey("node01")), controller.ReleaseClear)
+}
+
+func TestPlan(t *testing.T) {
+	is := is.New(t)
+	idx, machines, _ := mockIndex()
+	for _, m := range []*v1beta1.Machine{
+		mockMachine("m-update", "some"),
+		mockMachine("m-uptodate", "some"),
+		mockMachine("m-release", "other"),
+	} {
+		m.Status.NodeRef = &corev1.ObjectReference{Name: "node-" + m.Name[2:]}
+		is.NoErr(machines.Add(m))
+	}
+
+	update := mockHostSubnet("node-update")
+	uptodate := mockHostSubnet("node-uptodate")
+	uptodate.EgressCIDRs = []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}
+	markManaged(uptodate, "some", controller.ReleaseKeep)
+	release := mockHostSubnet("node-release")
+	release.EgressCIDRs = []v1.HostSubnetEgressCIDR{"198.51.100.0/24"}
+	markManaged(release, "other", controller.ReleaseClear)
+	unknown := mockHostSubnet("node-unknown")
+
+	cidrs := controller.NewCIDRMap()
+	is.NoErr(cidrs.Set("some", "192.0.2.0/24"))
+
+	plan := controller.Plan(controller.DefaultLayout(), []*v1.HostSubnet{update, uptodate, release, unknown}, cidrs, idx.MachineForNode)
+	is.Equal(len(plan), 4)
+
+	is.Equal(plan[0].Node, "node-release")
+	is.Equal(plan[0].Outcome, controller.OutcomeReleased)
+	is.True(plan[0].Pending)
+	is.Equal(plan[0].Desired, []v1.HostSubnetEgressCIDR{})
+
+	is.Equal(plan[1].Node, "node-unknown")
+	is.Equal(plan[1].Outcome, controller.OutcomeError)
+	is.True(!plan[1].Pending)
+
+	is.Equal(plan[2].Node, "node-update")
+	is.Equal(plan[2].Outcome, controller.OutcomeUpdated)
+	is.True(plan[2].Pending)
+	is.Equal(plan[2].MachineSet, "some")
+	is.Equal(plan[2].Desired, []v1.HostSubnetEgressCIDR{"192.0.2.0/24"})
+
+	is.Equal(plan[3].Node, "node-uptodate")
+	is.Equal(plan[3].Outcome, controller.OutcomeUpToDate)
+	is.True(!plan[3].Pending)
+
+	is.Equal(update.EgressCIDRs, nil) // input is not modified
+}
+
+func mockOptions(release controller.ReleasePolicy) controller.Options {
+	return controller.Options{
+		Layout:               controller.DefaultLayout(),
+		DefaultReleasePolicy: release,
+	}
+}
@@ -0,0 +1,379 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/apis/egress/v1alpha1"
+	v1 "github.com/openshift/api/network/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// policyQueueKey is the only key in the policy queue. Policies are always
+// resolved together, so there is no point in tracking them individually.
+const policyQueueKey = "policies"
+
+// createPolicyInformer sets up the EgressCIDRPolicy informer, if the API is
+// available in the cluster.
+func (c *Controller) createPolicyInformer() {
+	gv := v1alpha1.SchemeGroupVersion.String()
+	if _, err := c.kubeClient.Discovery().ServerResourcesForGroupVersion(gv); err != nil {
+		klog.Infof("EgressCIDRPolicy API %s not available, policies disabled: %s", gv, err)
+		return
+	}
+
+	client, err := dynamic.NewForConfig(c.config)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, c.resyncPeriod)
+	informer := factory.ForResource(v1alpha1.EgressCIDRPolicies)
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.enqueuePolicySync() },
+		UpdateFunc: func(interface{}, interface{}) { c.enqueuePolicySync() },
+		DeleteFunc: func(interface{}) { c.enqueuePolicySync() },
+	})
+
+	c.dynamicInformerFactory = factory
+	c.policyInformer = informer
+	c.policyClient = client.Resource(v1alpha1.EgressCIDRPolicies)
+}
+
+// enqueuePolicySync schedules a resolution of all policies.
+func (c *Controller) enqueuePolicySync() {
+	if c.policyInformer == nil {
+		return
+	}
+	c.policyQueue.Add(policyQueueKey)
+}
+
+func (c *Controller) runPolicyWorker(ctx context.Context) {
+	for c.processNextPolicySync(ctx) {
+	}
+}
+
+func (c *Controller) processNextPolicySync(ctx context.Context) bool {
+	key, quit := c.policyQueue.Get()
+	if quit {
+		return false
+	}
+	defer c.policyQueue.Done(key)
+	if c.policyQueue.ShuttingDown() {
+		return false
+	}
+
+	if err := c.syncPolicies(ctx); err != nil {
+		klog.Errorf("EgressCIDRPolicies: requeue after %d retries: %s",
+			c.policyQueue.NumRequeues(key), err)
+		c.policyQueue.AddRateLimited(key)
+		return true
+	}
+
+	c.policyQueue.Forget(key)
+	return true
+}
+
+// policyOwned returns true if the CIDRMap entry `key` was set by a policy.
+func (c *Controller) policyOwned(key string) bool {
+	c.policyMutex.Lock()
+	defer c.policyMutex.Unlock()
+	return c.policyKeys[key] != ""
+}
+
+// kubeObject is a MachineSet or Node events can be recorded on.
+type kubeObject interface {
+	metav1.Object
+	runtime.Object
+}
+
+// targetOf returns the MachineSet or Node of the CIDRMap entry `key`, or nil
+// if it's gone.
+func (c *Controller) targetOf(key string) kubeObject {
+	if strings.HasPrefix(key, nodeKeyPrefix) {
+		node, err := c.nodeInformer.Lister().Get(strings.TrimPrefix(key, nodeKeyPrefix))
+		if err != nil {
+			return nil
+		}
+		return node
+	}
+	ms, err := c.machineSets.Get(key)
+	if err != nil {
+		return nil
+	}
+	return ms
+}
+
+// guardPolicyEntry applies the check of guardCIDRs to the CIDRMap entry `key`
+// set from policy `p`, which is nil if the policy is gone. The change is
+// forced by AnnotationForceCIDRs on the policy or on the target of `key`, and
+// events are recorded on the target. Returns why the change was refused, or
+// an empty string if it may be applied.
+func (c *Controller) guardPolicyEntry(key string, proposed []v1.HostSubnetEgressCIDR, p *v1alpha1.EgressCIDRPolicy) string {
+	msg := c.strandedBy(key, proposed)
+	if msg == "" {
+		return ""
+	}
+
+	kind, name := keyTarget(key)
+	target := c.targetOf(key)
+	if p != nil && forcesCIDRs(p) || target != nil && forcesCIDRs(target) {
+		klog.Warningf("%s<%s>: forced change of egress CIDRs to %v, NetNamespaces lose egress IPs: %s", kind, name, proposed, msg)
+		if target != nil {
+			c.recorder.Eventf(target, corev1.EventTypeWarning, ReasonCIDRsInUse,
+				"Forced change of egress CIDRs to %v from EgressCIDRPolicy, NetNamespaces lose egress IPs: %s", proposed, msg)
+		}
+		return ""
+	}
+	klog.Errorf("%s<%s>: refusing egress CIDRs %v from EgressCIDRPolicy, keeping %v: NetNamespaces would lose egress IPs: %s",
+		kind, name, proposed, c.cidrs.Get(key), msg)
+	if target != nil {
+		c.recorder.Eventf(target, corev1.EventTypeWarning, ReasonCIDRsInUse,
+			"Refusing egress CIDRs %v from EgressCIDRPolicy, keeping %v: NetNamespaces would lose egress IPs: %s. Set annotation %s=true to apply anyway",
+			proposed, c.cidrs.Get(key), msg, AnnotationForceCIDRs)
+	}
+	return fmt.Sprintf("%s (NetNamespaces would lose egress IPs: %s)", name, msg)
+}
+
+// checkPolicyOverlaps checks the CIDRs `cidrs` of the CIDRMap entry `key`
+// for overlaps with entries not claimed by the same policy according to
+// `owners`, as syncMachineSet does for annotations. Overlaps are recorded as
+// events on the target of `key`. With `strict`, returns why the entry was
+// refused, otherwise an empty string.
+func (c *Controller) checkPolicyOverlaps(key, cidrs string, owners map[string]string, strict bool) string {
+	overlaps := policyOverlaps(c.cidrs, key, cidrs, owners)
+	if len(overlaps) == 0 {
+		return ""
+	}
+
+	msg := joinOverlaps(overlaps)
+	kind, name := keyTarget(key)
+	target := c.targetOf(key)
+	if !strict {
+		klog.Warningf("%s<%s>: %s", kind, name, msg)
+		if target != nil {
+			c.recorder.Eventf(target, corev1.EventTypeWarning, ReasonOverlap, "%s", msg)
+		}
+		return ""
+	}
+	klog.Errorf("%s<%s>: refusing CIDRs of EgressCIDRPolicy %s: %s", kind, name, owners[key], msg)
+	if target != nil {
+		c.recorder.Eventf(target, corev1.EventTypeWarning, ReasonOverlap,
+			"Refusing CIDRs of EgressCIDRPolicy %s, keeping %v: %s", owners[key], c.cidrs.Get(key), msg)
+	}
+	return fmt.Sprintf("%s (%s)", name, msg)
+}
+
+// syncPolicies resolves all policies, feeds the result into the CIDRMap and
+// updates the status of each policy.
+func (c *Controller) syncPolicies(ctx context.Context) error {
+	objs, err := c.policyInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	policies := make([]*v1alpha1.EgressCIDRPolicy, 0, len(objs))
+	for _, obj := range objs {
+		p := new(v1alpha1.EgressCIDRPolicy)
+		u := obj.(*unstructured.Unstructured)
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), p); err != nil {
+			klog.Errorf("EgressCIDRPolicy<%s>: decode: %s", u.GetName(), err)
+			continue
+		}
+		policies = append(policies, p)
+	}
+
+	machineSets, err := c.machineSets.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	nodes, err := c.nodeInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	current := c.current()
+	entries, results := ResolvePolicies(current.layout, c.cidrs.Reserved(), policies, machineSets, nodes)
+	byName := make(map[string]*v1alpha1.EgressCIDRPolicy, len(policies))
+	for _, p := range policies {
+		byName[p.Name] = p
+	}
+	owners := policyOwners(results)
+
+	c.policyMutex.Lock()
+	changed := make([]string, 0)
+	for key, owner := range c.policyKeys {
+		if _, ok := entries[key]; ok {
+			continue
+		}
+		// The MachineSet might have been annotated in the meantime
+		if ms, err := c.machineSets.Get(key); err == nil && current.layout.EgressCIDRsOf(ms) != "" {
+			delete(c.policyKeys, key)
+			continue
+		}
+		if refused := c.guardPolicyEntry(key, nil, byName[owner]); refused != "" {
+			if res, ok := results[owner]; ok {
+				res.Refused = append(res.Refused, refused)
+			}
+			continue
+		}
+		delete(c.policyKeys, key)
+		c.cidrs.Delete(key)
+		changed = append(changed, key)
+	}
+	for _, key := range sortedEntryKeys(entries) {
+		cidrs, owner := entries[key], owners[key]
+		if c.cidrs.Equals(key, cidrs) && c.cidrs.ReleasePolicy(key) == current.defaultRelease {
+			c.policyKeys[key] = owner
+			continue
+		}
+		if refused := c.checkPolicyOverlaps(key, cidrs, owners, current.strictOverlaps); refused != "" {
+			results[owner].Refused = append(results[owner].Refused, refused)
+			continue
+		}
+		// Validated by ResolvePolicies
+		proposed, _ := parseCIDRs(cidrs)
+		if refused := c.guardPolicyEntry(key, proposed, byName[owner]); refused != "" {
+			results[owner].Refused = append(results[owner].Refused, refused)
+			continue
+		}
+		c.policyKeys[key] = owner
+		_ = c.cidrs.Set(key, cidrs)
+		c.cidrs.SetReleasePolicy(key, current.defaultRelease)
+		changed = append(changed, key)
+	}
+	c.policyMutex.Unlock()
+
+	for _, key := range changed {
+		c.triggerReconcileKey(key)
+	}
+	if len(changed) > 0 {
+		// MachineSets refused for overlapping a previous entry
+		c.retryRefused()
+	}
+
+	var errs []string
+	for _, p := range policies {
+		if err := c.updatePolicyStatus(ctx, p, results[p.Name]); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", p.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("update status: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// triggerReconcileKey enqueues all HostSubnets affected by the CIDRMap entry
+// `key`.
+func (c *Controller) triggerReconcileKey(key string) {
+	if strings.HasPrefix(key, nodeKeyPrefix) {
+		c.enqueue(strings.TrimPrefix(key, nodeKeyPrefix))
+		return
+	}
+	c.triggerReconcile(key)
+}
+
+// nodesForKey returns the names of all nodes affected by the CIDRMap entry
+// `key`.
+func (c *Controller) nodesForKey(key string) []string {
+	if strings.HasPrefix(key, nodeKeyPrefix) {
+		return []string{strings.TrimPrefix(key, nodeKeyPrefix)}
+	}
+
+	layout := c.current().layout
+	machines, err := c.machines.List(labels.SelectorFromSet(labels.Set{layout.MachineSetLabel: key}))
+	if err != nil {
+		klog.Errorf("MachineSet<%s>: list machines: %s", key, err)
+		return nil
+	}
+
+	nodes := make([]string, 0, len(machines))
+	for _, m := range machines {
+		if layout.Ignores(m) {
+			continue
+		}
+		if node, err := c.index.NodeForMachine(m); err == nil && node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func (c *Controller) updatePolicyStatus(ctx context.Context, p *v1alpha1.EgressCIDRPolicy, res *PolicyResult) error {
+	status := v1alpha1.EgressCIDRPolicyStatus{
+		ObservedGeneration: p.Generation,
+	}
+
+	switch {
+	case res.Err != nil:
+		status.SyncState = v1alpha1.SyncStateInvalid
+		status.Message = res.Err.Error()
+	default:
+		desired, _ := parseCIDRs(res.CIDRs)
+		layout := c.current().layout
+		outOfSync := 0
+		for _, key := range res.Keys {
+			for _, node := range c.nodesForKey(key) {
+				status.MatchedNodes = append(status.MatchedNodes, node)
+				if !c.target.inSync(layout, node, desired) {
+					outOfSync++
+				}
+			}
+		}
+		sort.Strings(status.MatchedNodes)
+
+		switch {
+		case len(res.Conflicts) > 0 || len(res.Refused) > 0:
+			status.SyncState = v1alpha1.SyncStateConflict
+			msgs := make([]string, 0, 2)
+			if len(res.Conflicts) > 0 {
+				msgs = append(msgs, "Not managing "+strings.Join(res.Conflicts, ", "))
+			}
+			if len(res.Refused) > 0 {
+				refused := append([]string(nil), res.Refused...)
+				sort.Strings(refused)
+				msgs = append(msgs, "Not applied to "+strings.Join(refused, ", "))
+			}
+			status.Message = strings.Join(msgs, "; ")
+		case outOfSync > 0:
+			status.SyncState = v1alpha1.SyncStateOutOfSync
+			status.Message = fmt.Sprintf("%d of %d nodes out of sync", outOfSync, len(status.MatchedNodes))
+		default:
+			status.SyncState = v1alpha1.SyncStateSynced
+			status.Message = fmt.Sprintf("%d nodes in sync", len(status.MatchedNodes))
+		}
+	}
+
+	if equality.Semantic.DeepEqual(p.Status, status) {
+		return nil
+	}
+
+	if c.current().dryRun {
+		klog.Infof("EgressCIDRPolicy<%s>: dry run, not updating status: %s %s", p.Name, status.SyncState, status.Message)
+		return nil
+	}
+
+	p.Status = status
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(p)
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	u.SetGroupVersionKind(v1alpha1.SchemeGroupVersion.WithKind("EgressCIDRPolicy"))
+
+	_, err = c.policyClient.UpdateStatus(ctx, u, metav1.UpdateOptions{
+		FieldManager: FieldManager,
+	})
+	return err
+}
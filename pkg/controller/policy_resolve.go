@@ -0,0 +1,205 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/apis/egress/v1alpha1"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const nodeKeyPrefix = "node/"
+
+// NodeKey returns the CIDRMap key for entries targeting a single node rather
+// than a MachineSet. MachineSet names can't contain a slash, so the keys never
+// collide.
+func NodeKey(node string) string {
+	return nodeKeyPrefix + node
+}
+
+// PolicyResult is the outcome of resolving a single EgressCIDRPolicy.
+type PolicyResult struct {
+	// Keys are the CIDRMap keys (MachineSet names or NodeKeys) claimed by the
+	// policy.
+	Keys []string
+	// Conflicts lists targets the policy matched but which are already
+	// claimed by a MachineSet annotation or an older policy.
+	Conflicts []string
+	// Refused lists targets whose CIDRs were not changed, with the reason.
+	// Set by the controller, not by ResolvePolicies.
+	Refused []string
+	// CIDRs is the canonicalized value of the policy.
+	CIDRs string
+	// Err is set if the policy is invalid.
+	Err error
+}
+
+// ResolvePolicies computes which MachineSets and nodes are targeted by which
+// policy. It returns the CIDRMap entries to set and a result per policy name.
+//
+// MachineSets annotated with the EgressCIDRsAnnotation of `layout` are never
+// claimed by a policy. If several policies match the same target, the oldest one wins.
+// Policies in ApplyModeObserve claim their targets but produce no entries.
+// Policies whose CIDRs collide with one of the `reserved` networks are invalid.
+func ResolvePolicies(
+	layout Layout,
+	reserved []ReservedNetwork,
+	policies []*v1alpha1.EgressCIDRPolicy,
+	machineSets []*v1beta1.MachineSet,
+	nodes []*corev1.Node,
+) (map[string]string, map[string]*PolicyResult) {
+	sorted := make([]*v1alpha1.EgressCIDRPolicy, len(policies))
+	copy(sorted, policies)
+	sort.Slice(sorted, func(i, j int) bool {
+		ti, tj := sorted[i].CreationTimestamp, sorted[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	annotated := make(map[string]bool)
+	for _, ms := range machineSets {
+		if layout.EgressCIDRsOf(ms) != "" {
+			annotated[ms.Name] = true
+		}
+	}
+
+	entries := make(map[string]string)
+	results := make(map[string]*PolicyResult, len(sorted))
+	owners := make(map[string]string)
+
+	for _, p := range sorted {
+		res := new(PolicyResult)
+		results[p.Name] = res
+
+		targets, err := policyTargets(layout, p, machineSets, nodes)
+		if err == nil {
+			res.CIDRs, err = policyCIDRs(p, reserved)
+		}
+		if err != nil {
+			res.Err = err
+			continue
+		}
+
+		for _, key := range targets {
+			if annotated[key] {
+				res.Conflicts = append(res.Conflicts,
+					fmt.Sprintf("%s (claimed by annotation %s)", key, layout.EgressCIDRsAnnotation))
+				continue
+			}
+			if owner, ok := owners[key]; ok {
+				res.Conflicts = append(res.Conflicts,
+					fmt.Sprintf("%s (claimed by EgressCIDRPolicy %s)", key, owner))
+				continue
+			}
+
+			owners[key] = p.Name
+			res.Keys = append(res.Keys, key)
+			if p.Spec.ApplyMode != v1alpha1.ApplyModeObserve {
+				entries[key] = res.CIDRs
+			}
+		}
+	}
+
+	return entries, results
+}
+
+// policyOwners returns the name of the policy claiming each CIDRMap key in
+// `results`.
+func policyOwners(results map[string]*PolicyResult) map[string]string {
+	owners := make(map[string]string)
+	for name, res := range results {
+		for _, key := range res.Keys {
+			owners[key] = name
+		}
+	}
+	return owners
+}
+
+// policyOverlaps returns the overlaps between the CIDRs `s` of the CIDRMap
+// entry `key` and all other entries of `cidrs`. The targets of a policy
+// share its CIDRs, so entries claimed by the same policy according to
+// `owners` are left out.
+func policyOverlaps(cidrs *CIDRMap, key, s string, owners map[string]string) []Overlap {
+	overlaps := make([]Overlap, 0)
+	for _, o := range cidrs.Overlapping(key, s) {
+		if owners[o.OtherKey] != owners[key] {
+			overlaps = append(overlaps, o)
+		}
+	}
+	return overlaps
+}
+
+// sortedEntryKeys returns the keys of the entries returned by
+// ResolvePolicies, sorted.
+func sortedEntryKeys(entries map[string]string) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// policyTargets returns the CIDRMap keys matched by the selector of `p`.
+// Nodes with one of the IgnoredRoles of `layout` are never matched.
+func policyTargets(layout Layout, p *v1alpha1.EgressCIDRPolicy, machineSets []*v1beta1.MachineSet, nodes []*corev1.Node) ([]string, error) {
+	spec := p.Spec
+	if (spec.MachineSetSelector == nil) == (spec.NodeSelector == nil) {
+		return nil, errors.New("exactly one of machineSetSelector and nodeSelector must be set")
+	}
+	switch spec.ApplyMode {
+	case "", v1alpha1.ApplyModeEnforce, v1alpha1.ApplyModeObserve:
+	default:
+		return nil, fmt.Errorf("unknown applyMode %q", spec.ApplyMode)
+	}
+
+	keys := make([]string, 0)
+	if spec.MachineSetSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(spec.MachineSetSelector)
+		if err != nil {
+			return nil, fmt.Errorf("machineSetSelector: %w", err)
+		}
+		for _, ms := range machineSets {
+			if selector.Matches(labels.Set(ms.Labels)) {
+				keys = append(keys, ms.Name)
+			}
+		}
+	} else {
+		selector, err := metav1.LabelSelectorAsSelector(spec.NodeSelector)
+		if err != nil {
+			return nil, fmt.Errorf("nodeSelector: %w", err)
+		}
+		for _, n := range nodes {
+			if selector.Matches(labels.Set(n.Labels)) && !layout.IgnoresNode(n) {
+				keys = append(keys, NodeKey(n.Name))
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// policyCIDRs validates the CIDRs of `p` and returns them in the format
+// accepted by CIDRMap.Set.
+func policyCIDRs(p *v1alpha1.EgressCIDRPolicy, reserved []ReservedNetwork) (string, error) {
+	if len(p.Spec.CIDRs) == 0 {
+		return "none", nil
+	}
+
+	cidrs, err := parseCIDRs(strings.Join(p.Spec.CIDRs, ","))
+	if err != nil {
+		return "", err
+	}
+	if err := checkReserved(reserved, cidrs); err != nil {
+		return "", err
+	}
+	return strings.Join(egressCIDRsToStrings(cidrs), ","), nil
+}
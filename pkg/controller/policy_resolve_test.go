@@ -0,0 +1,159 @@
+package controller_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/apis/egress/v1alpha1"
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	"github.com/matryer/is"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResolvePoliciesMachineSetSelector(t *testing.T) {
+	is := is.New(t)
+	machineSets := []*v1beta1.MachineSet{
+		mockMachineSet("app-a", map[string]string{"tier": "app"}, ""),
+		mockMachineSet("app-b", map[string]string{"tier": "app"}, ""),
+		mockMachineSet("infra", map[string]string{"tier": "infra"}, ""),
+	}
+	p := mockPolicy("app", 0, "203.0.113.0/24", "192.0.2.5/24")
+	p.Spec.MachineSetSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "app"}}
+
+	entries, results := controller.ResolvePolicies(controller.DefaultLayout(), nil, []*v1alpha1.EgressCIDRPolicy{p}, machineSets, nil)
+
+	is.Equal(entries, map[string]string{
+		"app-a": "192.0.2.0/24,203.0.113.0/24",
+		"app-b": "192.0.2.0/24,203.0.113.0/24",
+	})
+	is.NoErr(results["app"].Err)
+	is.Equal(results["app"].Keys, []string{"app-a", "app-b"})
+	is.Equal(len(results["app"].Conflicts), 0)
+}
+
+func TestResolvePoliciesNodeSelector(t *testing.T) {
+	is := is.New(t)
+	nodes := []*corev1.Node{
+		mockNode("node01", ""),
+		mockNode("node02", ""),
+	}
+	nodes[1].SetLabels(map[string]string{"egress": "true"})
+	p := mockPolicy("egress", 0)
+	p.Spec.NodeSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"egress": "true"}}
+
+	entries, results := controller.ResolvePolicies(controller.DefaultLayout(), nil, []*v1alpha1.EgressCIDRPolicy{p}, nil, nodes)
+
+	is.Equal(entries, map[string]string{controller.NodeKey("node02"): "none"})
+	is.Equal(results["egress"].Keys, []string{controller.NodeKey("node02")})
+}
+
+func TestResolvePoliciesNodeSelectorIgnoresMasters(t *testing.T) {
+	is := is.New(t)
+	nodes := []*corev1.Node{
+		mockNode("master01", ""),
+		mockNode("worker01", ""),
+	}
+	nodes[0].SetLabels(map[string]string{controller.NodeRoleLabelPrefix + "master": ""})
+	nodes[1].SetLabels(map[string]string{controller.NodeRoleLabelPrefix + "worker": ""})
+	p := mockPolicy("all", 0, "192.0.2.0/24")
+	p.Spec.NodeSelector = &metav1.LabelSelector{}
+
+	entries, results := controller.ResolvePolicies(controller.DefaultLayout(), nil, []*v1alpha1.EgressCIDRPolicy{p}, nil, nodes)
+
+	is.Equal(entries, map[string]string{controller.NodeKey("worker01"): "192.0.2.0/24"})
+	is.Equal(results["all"].Keys, []string{controller.NodeKey("worker01")})
+}
+
+func TestResolvePoliciesConflicts(t *testing.T) {
+	is := is.New(t)
+	machineSets := []*v1beta1.MachineSet{
+		mockMachineSet("app-a", map[string]string{"tier": "app"}, "198.51.100.0/24"),
+		mockMachineSet("app-b", map[string]string{"tier": "app"}, ""),
+	}
+	older := mockPolicy("older", 0, "192.0.2.0/24")
+	older.Spec.MachineSetSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "app"}}
+	newer := mockPolicy("newer", time.Hour, "203.0.113.0/24")
+	newer.Spec.MachineSetSelector = &metav1.LabelSelector{}
+
+	entries, results := controller.ResolvePolicies(controller.DefaultLayout(), nil,
+		[]*v1alpha1.EgressCIDRPolicy{newer, older}, machineSets, nil)
+
+	is.Equal(entries, map[string]string{"app-b": "192.0.2.0/24"})
+	is.Equal(results["older"].Keys, []string{"app-b"})
+	is.Equal(len(results["older"].Conflicts), 1) // app-a is annotated
+	is.Equal(len(results["newer"].Keys), 0)
+	is.Equal(len(results["newer"].Conflicts), 2)
+}
+
+func TestResolvePoliciesObserve(t *testing.T) {
+	is := is.New(t)
+	machineSets := []*v1beta1.MachineSet{
+		mockMachineSet("app-a", nil, ""),
+	}
+	p := mockPolicy("observe", 0, "192.0.2.0/24")
+	p.Spec.MachineSetSelector = &metav1.LabelSelector{}
+	p.Spec.ApplyMode = v1alpha1.ApplyModeObserve
+
+	entries, results := controller.ResolvePolicies(controller.DefaultLayout(), nil, []*v1alpha1.EgressCIDRPolicy{p}, machineSets, nil)
+
+	is.Equal(len(entries), 0)
+	is.Equal(results["observe"].Keys, []string{"app-a"})
+	is.Equal(results["observe"].CIDRs, "192.0.2.0/24")
+}
+
+func TestResolvePoliciesInvalid(t *testing.T) {
+	is := is.New(t)
+
+	noSelector := mockPolicy("no-selector", 0, "192.0.2.0/24")
+	badCIDR := mockPolicy("bad-cidr", 0, "foo")
+	badCIDR.Spec.NodeSelector = &metav1.LabelSelector{}
+	badMode := mockPolicy("bad-mode", 0, "192.0.2.0/24")
+	badMode.Spec.NodeSelector = &metav1.LabelSelector{}
+	badMode.Spec.ApplyMode = "Sometimes"
+
+	entries, results := controller.ResolvePolicies(controller.DefaultLayout(), nil,
+		[]*v1alpha1.EgressCIDRPolicy{noSelector, badCIDR, badMode}, nil, []*corev1.Node{mockNode("node01", "")})
+
+	is.Equal(len(entries), 0)
+	is.True(results["no-selector"].Err != nil)
+	is.True(results["bad-cidr"].Err != nil)
+	is.True(results["bad-mode"].Err != nil)
+}
+
+func TestResolvePoliciesReserved(t *testing.T) {
+	is := is.New(t)
+	reserved := controller.ParseReservedNetworks("service network", false, "172.30.0.0/16")
+
+	older := mockPolicy("service", 0, "172.30.0.0/24")
+	older.Spec.NodeSelector = &metav1.LabelSelector{}
+	newer := mockPolicy("egress", time.Hour, "192.0.2.0/24")
+	newer.Spec.NodeSelector = &metav1.LabelSelector{}
+
+	entries, results := controller.ResolvePolicies(controller.DefaultLayout(), reserved,
+		[]*v1alpha1.EgressCIDRPolicy{older, newer}, nil, []*corev1.Node{mockNode("node01", "")})
+
+	is.True(results["service"].Err != nil)
+	// the rejected policy doesn't claim the node
+	is.Equal(entries, map[string]string{controller.NodeKey("node01"): "192.0.2.0/24"})
+}
+
+func mockPolicy(name string, age time.Duration, cidrs ...string) *v1alpha1.EgressCIDRPolicy {
+	p := new(v1alpha1.EgressCIDRPolicy)
+	p.SetName(name)
+	p.SetCreationTimestamp(metav1.NewTime(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC).Add(age)))
+	p.Spec.CIDRs = cidrs
+	return p
+}
+
+func mockMachineSet(name string, labels map[string]string, cidrs string) *v1beta1.MachineSet {
+	ms := new(v1beta1.MachineSet)
+	ms.SetName(name)
+	ms.SetNamespace(controller.MachineNamespace)
+	ms.SetLabels(labels)
+	if cidrs != "" {
+		ms.SetAnnotations(map[string]string{controller.AnnotationEgressCIDRS: cidrs})
+	}
+	return ms
+}
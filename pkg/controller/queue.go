@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"context"
+
+	"k8s.io/klog/v2"
+)
+
+// enqueue schedules a reconciliation of the HostSubnet with the given name.
+func (c *Controller) enqueue(hostSubnet string) {
+	c.queue.Add(hostSubnet)
+}
+
+// runWorker processes items until the queue is shut down. All writes use
+// `ctx`.
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+// processNextItem takes one HostSubnet name off the queue and reconciles it.
+// Failed items are requeued with exponential backoff. Returns false once the
+// queue has been shut down, dropping the remaining items.
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	c.health.progress()
+	defer c.health.progress()
+	defer c.queue.Done(key)
+	if c.queue.ShuttingDown() {
+		return false
+	}
+
+	name := key.(string)
+	res := c.reconcile(ctx, name)
+	if res.Requeue {
+		klog.Errorf("HostSubnet<%s>: requeue after %d retries: %s",
+			name, c.queue.NumRequeues(key), res)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *Controller) reconcile(ctx context.Context, name string) ReconcileResult {
+	res := c.target.reconcile(ctx, c.current(), name)
+	reconcileTotal.WithLabelValues(string(res.Outcome), res.MachineSet).Inc()
+	return res
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"net"
+
+	v1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// nodeIPs returns the IPv4 InternalIP addresses of `machine`, falling back to
+// the HostIP of `hs` if `machine` is nil or has none.
+func nodeIPs(hs *v1.HostSubnet, machine *v1beta1.Machine) []net.IP {
+	ips := make([]net.IP, 0)
+	if machine != nil {
+		for _, addr := range machine.Status.Addresses {
+			if addr.Type != corev1.NodeInternalIP {
+				continue
+			}
+			if ip := net.ParseIP(addr.Address).To4(); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if ip := net.ParseIP(hs.HostIP).To4(); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// reachableCIDRs splits `cidrs` into those within the subnet of length
+// `prefix` of one of the node `ips`, and the rest.
+func reachableCIDRs(cidrs []v1.HostSubnetEgressCIDR, ips []net.IP, prefix int) (reachable, unreachable []v1.HostSubnetEgressCIDR) {
+	subnets := make([]*net.IPNet, len(ips))
+	for i, ip := range ips {
+		mask := net.CIDRMask(prefix, 32)
+		subnets[i] = &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+
+	reachable = make([]v1.HostSubnetEgressCIDR, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(string(cidr))
+		if err != nil {
+			continue
+		}
+		size, _ := ipnet.Mask.Size()
+		found := false
+		for _, subnet := range subnets {
+			if subnet.Contains(ipnet.IP) && size >= prefix {
+				found = true
+				break
+			}
+		}
+		if found {
+			reachable = append(reachable, cidr)
+		} else {
+			unreachable = append(unreachable, cidr)
+		}
+	}
+	return reachable, unreachable
+}
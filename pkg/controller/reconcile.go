@@ -1,64 +1,148 @@
 package controller
 
 import (
-	"context"
+	"strings"
 
 	v1 "github.com/openshift/api/network/v1"
 	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/klog/v2"
 )
 
-type MachineGetter func(name string) (*v1beta1.Machine, error)
-type HostSubnetUpdater func(ctx context.Context, hostSubnet *v1.HostSubnet, opts metav1.UpdateOptions) (*v1.HostSubnet, error)
+// MachineGetter returns the Machine backing the Node with the given name.
+type MachineGetter func(nodeName string) (*v1beta1.Machine, error)
 
+// ReconcileSubnet sets the egressCIDRs of `hs` to the CIDRs configured for the
+// MachineSet of its node, and its egressIPs to the egress IPs assigned to it.
 func ReconcileSubnet(
+	layout Layout,
 	hs *v1.HostSubnet,
 	cidrs *CIDRMap,
 	getMachine MachineGetter,
-	updateHostSubnet HostSubnetUpdater,
-) string {
-	klog.V(8).Infof("HostSubnet<%s>: Reconcile", hs.Name)
-	machine, err := getMachine(hs.Name)
+	patchHostSubnet HostSubnetPatcher,
+	recordEvent Recorder,
+) ReconcileResult {
+	return reconcileObject(layout, subnetObject{hs, patchHostSubnet, recordEvent}, cidrs, getMachine)
+}
+
+// reconcileObject applies the CIDRMap entry of the node of `obj`, or of the
+// MachineSet of its Machine, to `obj`. Objects no longer covered by an entry
+// are released.
+func reconcileObject(layout Layout, obj egressObject, cidrs *CIDRMap, getMachine MachineGetter) ReconcileResult {
+	kind, name := obj.kind(), obj.GetName()
+	managedBy := obj.GetAnnotations()[AnnotationManagedBy]
+	klog.V(8).Infof("%s<%s>: Reconcile", kind, name)
+	if key := NodeKey(name); cidrs.Exists(key) {
+		// Selected by an EgressCIDRPolicy node selector, no Machine needed
+		return applyEntry(layout, obj, nil, cidrs, key, "")
+	}
+
+	machine, err := getMachine(name)
+	if err != nil && strings.HasPrefix(managedBy, nodeKeyPrefix) {
+		// No longer selected by a node selector, and not part of a MachineSet
+		return releaseObject(obj, "no cidr entry", "")
+	}
 	if err != nil {
-		klog.Errorf("HostSubnet<%s>: get machine: %s", hs.Name, err)
-		return "error getMachine: " + err.Error()
+		klog.Errorf("%s<%s>: get machine: %s", kind, name, err)
+		obj.record("", corev1.EventTypeWarning, ReasonUnresolvedNode,
+			"Cannot resolve Machine for node: %s", err)
+		return ReconcileResult{Outcome: OutcomeError, Reason: "get machine", Requeue: true, Err: err}
 	}
 
-	if machine.Labels[RoleLabel] == "master" {
-		klog.V(8).Infof("HostSubnet<%s>: role==master; ignore", hs.Name)
-		return "ignore master"
+	if layout.Ignores(machine) {
+		klog.V(8).Infof("%s<%s>: role==%s; ignore", kind, name, layout.RoleOf(machine))
+		if strings.HasPrefix(managedBy, nodeKeyPrefix) {
+			// Selected by a node selector before its role was ignored
+			return releaseObject(obj, "role is "+layout.RoleOf(machine), "")
+		}
+		return ReconcileResult{Outcome: OutcomeIgnored, Reason: "role is " + layout.RoleOf(machine)}
 	}
 
-	machineset := machine.Labels[MachinesetLabel]
+	machineset := layout.MachineSetOf(machine)
 	if machineset == "" {
-		klog.Errorf("HostSubnet<%s>: no '%s' label on machine", hs.Name, MachinesetLabel)
-		return "error: no machineset label"
+		klog.Errorf("%s<%s>: no '%s' label on machine", kind, name, layout.MachineSetLabel)
+		obj.record("", corev1.EventTypeWarning, ReasonNoMachineSet,
+			"Machine %s has no label %s", machine.Name, layout.MachineSetLabel)
+		if managedBy != "" {
+			return releaseObject(obj, "no machineset label", "")
+		}
+		return ReconcileResult{Outcome: OutcomeSkipped, Reason: "no machineset label"}
 	}
 
+	extra := obj.reconcileExtra(cidrs, machineset)
+	if extra.Outcome == OutcomeError {
+		return extra
+	}
+	res := reconcileCIDRs(layout, obj, machine, cidrs, machineset)
+	if (extra.Outcome == OutcomeUpdated || extra.Outcome == OutcomeReleased) &&
+		(res.Outcome == OutcomeUpToDate || res.Outcome == OutcomeSkipped) {
+		return extra
+	}
+	return res
+}
+
+// reconcileCIDRs applies the CIDRMap entry of `machineset` to `obj`, or
+// releases `obj` if there is none.
+func reconcileCIDRs(
+	layout Layout,
+	obj egressObject,
+	machine *v1beta1.Machine,
+	cidrs *CIDRMap,
+	machineset string,
+) ReconcileResult {
 	if !cidrs.Exists(machineset) {
-		klog.V(8).Infof("HostSubnet<%s>: No or empty entry in CIDR cache, skipping", hs.Name)
-		return "no cidr entry"
+		if obj.GetAnnotations()[AnnotationManagedBy] != "" {
+			return releaseObject(obj, "no cidr entry", machineset)
+		}
+		klog.V(8).Infof("%s<%s>: No or empty entry in CIDR cache, skipping", obj.kind(), obj.GetName())
+		return ReconcileResult{Outcome: OutcomeSkipped, Reason: "no cidr entry", MachineSet: machineset}
 	}
 
-	actual := hs.EgressCIDRs
-	if cidrs.EqualCIRDs(machineset, actual) {
-		klog.V(8).Infof("HostSubnet<%s>: Already matches desired value, skipping", hs.Name)
-		return "up to date"
+	return applyEntry(layout, obj, machine, cidrs, machineset, machineset)
+}
+
+// applyEntry applies the CIDRMap entry `key` to `obj` and marks it as managed
+// through `key`. `machine` may be nil, `machineset` is only used for reporting
+// and may be empty.
+func applyEntry(
+	layout Layout,
+	obj egressObject,
+	machine *v1beta1.Machine,
+	cidrs *CIDRMap,
+	key, machineset string,
+) ReconcileResult {
+	kind, name := obj.kind(), obj.GetName()
+	change := obj.change(layout, machine, cidrs.Get(key))
+
+	if change.upToDate && isManaged(obj, cidrs, key) {
+		klog.V(8).Infof("%s<%s>: Already matches desired value, skipping", kind, name)
+		return ReconcileResult{Outcome: OutcomeUpToDate, Reason: "up to date" + change.note, MachineSet: machineset}
 	}
 
-	desired := cidrs.Get(machineset)
-	klog.Infof("HostSubnet<%s>: Out of date, updating.", hs.Name)
-	klog.Infof("HostSubnet<%s>: Old value: %v", hs.Name, actual)
-	klog.Infof("HostSubnet<%s>: New value: %v", hs.Name, desired)
-	hs.EgressCIDRs = desired
-	_, err = updateHostSubnet(context.Background(), hs, metav1.UpdateOptions{
-		FieldManager: "openshift-machineset-egress-cidr-operator",
-	})
-	if err != nil {
-		klog.Error("HostSubnet<%s>: updating: %s", hs.Name, err)
-		return "error update hostsubnet: " + err.Error()
+	klog.Infof("%s<%s>: Out of date, setting %s", kind, name, change.what)
+	change.patch.Annotations = managedAnnotations(obj, cidrs, key)
+	// obj is owned by the informer cache and must not be modified
+	if err := obj.send(change.patch); err != nil {
+		klog.Errorf("%s<%s>: updating: %s", kind, name, err)
+		obj.record(machineset, corev1.EventTypeWarning, ReasonUpdateFailed,
+			"Failed to set %s: %s", change.what, err)
+		return ReconcileResult{
+			Outcome:    OutcomeError,
+			Reason:     "update " + strings.ToLower(kind),
+			MachineSet: machineset,
+			Requeue:    !apierrors.IsNotFound(err) && !apierrors.IsInvalid(err),
+			Err:        err,
+		}
 	}
 
-	return "updated"
+	source := "MachineSet " + machineset
+	if machineset == "" {
+		source = "EgressCIDRPolicy node selector"
+	}
+	obj.record(machineset, corev1.EventTypeNormal, ReasonUpdated, "%s from %s", change.done, source)
+	for _, warning := range change.warnings {
+		obj.record(machineset, corev1.EventTypeWarning, ReasonUnreachableCIDR, "%s", warning)
+	}
+	return ReconcileResult{Outcome: OutcomeUpdated, Reason: "updated" + change.note, MachineSet: machineset}
 }
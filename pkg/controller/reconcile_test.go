@@ -2,6 +2,7 @@ package controller_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"testing"
@@ -11,7 +12,10 @@ import (
 	"github.com/matryer/is"
 	v1 "github.com/openshift/api/network/v1"
 	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog/v2"
 )
 
@@ -31,7 +35,8 @@ func TestReconcileNoEntry(t *testing.T) {
 	cm := controller.NewCIDRMap()
 	getMachine, getMachineCalled := mockGetMachine(t, "some", hs.Name)
 
-	is.Equal(controller.ReconcileSubnet(hs, cm, getMachine, nil), "no cidr entry")
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, cm, getMachine, nil, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeSkipped)
 
 	is.Equal(*getMachineCalled, 1) // getMachine called exactly once
 }
@@ -40,11 +45,13 @@ func TestReconcileUpToDate(t *testing.T) {
 	is := is.New(t)
 	hs := mockHostSubnet("node123")
 	hs.EgressCIDRs = []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}
+	markManaged(hs, "some", controller.ReleaseKeep)
 	cm := controller.NewCIDRMap()
 	getMachine, getMachineCalled := mockGetMachine(t, "some", hs.Name)
-	cm.Set("some", "192.0.2.0/24")
+	is.NoErr(cm.Set("some", "192.0.2.0/24"))
 
-	is.Equal(controller.ReconcileSubnet(hs, cm, getMachine, nil), "up to date")
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, cm, getMachine, nil, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeUpToDate)
 
 	is.Equal(*getMachineCalled, 1) // getMachine called exactly once
 }
@@ -55,13 +62,17 @@ func TestReconcileSetNew(t *testing.T) {
 	cm := controller.NewCIDRMap()
 
 	getMachine, getMachineCalled := mockGetMachine(t, "some", hs.Name)
-	updateHostSubnet, updateHostSubnetCalled := mockUpdateHostSubnet(t, []v1.HostSubnetEgressCIDR{"192.0.2.0/24"})
+	patchHostSubnet, patchHostSubnetCalled := mockPatchHostSubnet(t, []v1.HostSubnetEgressCIDR{"192.0.2.0/24"})
 
-	cm.Set("some", "192.0.2.0/24")
-	is.Equal(controller.ReconcileSubnet(hs, cm, getMachine, updateHostSubnet), "updated")
+	recordEvent, events := mockRecorder()
 
-	is.Equal(*getMachineCalled, 1)       // getMachine called exactly once
-	is.Equal(*updateHostSubnetCalled, 1) // updateHostSubnet called exactly once
+	is.NoErr(cm.Set("some", "192.0.2.0/24"))
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, cm, getMachine, patchHostSubnet, recordEvent)
+	is.Equal(res.Outcome, controller.OutcomeUpdated)
+	is.Equal(*events, []string{"some Normal EgressCIDRsUpdated"})
+
+	is.Equal(*getMachineCalled, 1)      // getMachine called exactly once
+	is.Equal(*patchHostSubnetCalled, 1) // patchHostSubnet called exactly once
 }
 
 func TestReconcileUpdate(t *testing.T) {
@@ -71,14 +82,16 @@ func TestReconcileUpdate(t *testing.T) {
 	cm := controller.NewCIDRMap()
 
 	getMachine, getMachineCalled := mockGetMachine(t, "some", hs.Name)
-	updateHostSubnet, updateHostSubnetCalled := mockUpdateHostSubnet(t,
+	patchHostSubnet, patchHostSubnetCalled := mockPatchHostSubnet(t,
 		[]v1.HostSubnetEgressCIDR{"198.51.100.0/24", "203.0.113.0/24"})
 
-	cm.Set("some", "203.0.113.0/24,198.51.100.0/24")
-	is.Equal(controller.ReconcileSubnet(hs, cm, getMachine, updateHostSubnet), "updated")
+	is.NoErr(cm.Set("some", "203.0.113.0/24,198.51.100.0/24"))
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, cm, getMachine, patchHostSubnet, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeUpdated)
+	is.Equal(hs.EgressCIDRs, []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}) // cached object not modified
 
-	is.Equal(*getMachineCalled, 1)       // getMachine called exactly once
-	is.Equal(*updateHostSubnetCalled, 1) // updateHostSubnet called exactly once
+	is.Equal(*getMachineCalled, 1)      // getMachine called exactly once
+	is.Equal(*patchHostSubnetCalled, 1) // patchHostSubnet called exactly once
 }
 
 func TestReconcileErrGetMachine(t *testing.T) {
@@ -91,8 +104,14 @@ func TestReconcileErrGetMachine(t *testing.T) {
 		return nil, errors.New("oh noes")
 	}
 
-	is.Equal(controller.ReconcileSubnet(hs, nil, getMachine, nil), "error getMachine: oh noes")
+	recordEvent, events := mockRecorder()
+
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, controller.NewCIDRMap(), getMachine, nil, recordEvent)
+	is.Equal(res.Outcome, controller.OutcomeError)
+	is.True(res.Requeue)
+	is.Equal(res.Err.Error(), "oh noes")
 	is.Equal(counter, 1)
+	is.Equal(*events, []string{" Warning UnresolvedNode"})
 }
 
 func TestReconcileNoMachineset(t *testing.T) {
@@ -100,7 +119,10 @@ func TestReconcileNoMachineset(t *testing.T) {
 	hs := mockHostSubnet("node123")
 	getMachine, getMachineCalled := mockGetMachine(t, "", hs.Name)
 
-	is.Equal(controller.ReconcileSubnet(hs, nil, getMachine, nil), "error: no machineset label")
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, controller.NewCIDRMap(), getMachine, nil, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeSkipped)
+	is.Equal(res.Reason, "no machineset label")
+	is.True(!res.Requeue)
 	is.Equal(*getMachineCalled, 1)
 }
 
@@ -110,7 +132,10 @@ func TestReconcileNoCIDREntry(t *testing.T) {
 	cm := controller.NewCIDRMap()
 	getMachine, getMachineCalled := mockGetMachine(t, "aaa", hs.Name)
 
-	is.Equal(controller.ReconcileSubnet(hs, cm, getMachine, nil), "no cidr entry")
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, cm, getMachine, nil, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeSkipped)
+	is.Equal(res.Reason, "no cidr entry")
+	is.Equal(res.MachineSet, "aaa")
 	is.Equal(*getMachineCalled, 1)
 }
 
@@ -118,21 +143,45 @@ func TestReconcileErrUpdateHostsubnet(t *testing.T) {
 	is := is.New(t)
 	hs := mockHostSubnet("node123")
 	cm := controller.NewCIDRMap()
-	cm.Set("aaa", "203.0.113.0/24")
+	is.NoErr(cm.Set("aaa", "203.0.113.0/24"))
 	getMachine, getMachineCalled := mockGetMachine(t, "aaa", hs.Name)
-	updateHostSubnetCalled := 0
-	updateHostSubnet := func(ctx context.Context, hostSubnet *v1.HostSubnet, opts metav1.UpdateOptions) (*v1.HostSubnet, error) {
-		updateHostSubnetCalled++
+	patchHostSubnetCalled := 0
+	patchHostSubnet := func(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*v1.HostSubnet, error) {
+		patchHostSubnetCalled++
 		return nil, errors.New("some oopsie")
 	}
 
-	is.Equal(
-		controller.ReconcileSubnet(hs, cm, getMachine, updateHostSubnet),
-		"error update hostsubnet: some oopsie",
-	)
+	recordEvent, events := mockRecorder()
+
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, cm, getMachine, patchHostSubnet, recordEvent)
+	is.Equal(res.Outcome, controller.OutcomeError)
+	is.Equal(res.MachineSet, "aaa")
+	is.True(res.Requeue)
+	is.Equal(res.Err.Error(), "some oopsie")
+	is.Equal(*events, []string{"aaa Warning EgressCIDRsUpdateFailed"})
 
 	is.Equal(*getMachineCalled, 1)
-	is.Equal(updateHostSubnetCalled, 1)
+	is.Equal(patchHostSubnetCalled, 1)
+}
+
+func TestReconcileRetryConflict(t *testing.T) {
+	is := is.New(t)
+	hs := mockHostSubnet("node123")
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.Set("aaa", "203.0.113.0/24"))
+	getMachine, _ := mockGetMachine(t, "aaa", hs.Name)
+	patchHostSubnetCalled := 0
+	patchHostSubnet := func(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*v1.HostSubnet, error) {
+		patchHostSubnetCalled++
+		if patchHostSubnetCalled == 1 {
+			return nil, apierrors.NewConflict(v1.Resource("hostsubnets"), name, errors.New("stale"))
+		}
+		return hs, nil
+	}
+
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, cm, getMachine, patchHostSubnet, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeUpdated)
+	is.Equal(patchHostSubnetCalled, 2) // retried once after the conflict
 }
 
 func TestReconcileIgnoreMaster(t *testing.T) {
@@ -148,8 +197,258 @@ func TestReconcileIgnoreMaster(t *testing.T) {
 		return m, nil
 	}
 
-	is.Equal(controller.ReconcileSubnet(hs, nil, getMachine, nil), "ignore master")
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, controller.NewCIDRMap(), getMachine, nil, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeIgnored)
 	is.Equal(counter, 0) // getMachine called exactly once
+
+	// released if selected by a node selector before
+	hs.EgressCIDRs = []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}
+	markManaged(hs, controller.NodeKey(hs.Name), controller.ReleaseClear)
+	patchHostSubnet, patches := capturePatches()
+	res = controller.ReconcileSubnet(controller.DefaultLayout(), hs, controller.NewCIDRMap(), getMachine, patchHostSubnet, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeReleased)
+	is.Equal(patchedEgressCIDRs(t, *patches), []v1.HostSubnetEgressCIDR{})
+}
+
+func TestReconcileLayout(t *testing.T) {
+	is := is.New(t)
+	hs := mockHostSubnet("node123")
+	layout := controller.DefaultLayout()
+	layout.MachineSetLabel = "example.com/pool"
+	layout.IgnoredRoles = []string{"infra"}
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.Set("some", "192.0.2.0/24"))
+	patchHostSubnet, patches := capturePatches()
+
+	m := new(v1beta1.Machine)
+	m.SetLabels(map[string]string{
+		"example.com/pool":   "some",
+		controller.RoleLabel: "master",
+	})
+	getMachine := func(string) (*v1beta1.Machine, error) { return m, nil }
+
+	res := controller.ReconcileSubnet(layout, hs, cm, getMachine, patchHostSubnet, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeUpdated) // masters are managed if not ignored
+	is.Equal(res.MachineSet, "some")
+	is.Equal(len(*patches), 1)
+
+	m.Labels[controller.RoleLabel] = "infra"
+	res = controller.ReconcileSubnet(layout, hs, cm, getMachine, patchHostSubnet, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeIgnored)
+	is.Equal(len(*patches), 1)
+}
+
+func TestReconcileUnreachable(t *testing.T) {
+	is := is.New(t)
+	hs := mockHostSubnet("node123")
+	hs.HostIP = "198.51.100.10"
+	layout := controller.DefaultLayout()
+	layout.NodeSubnetPrefix = 24
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.Set("some", "192.0.2.128/25,198.51.100.0/25"))
+	patchHostSubnet, patches := capturePatches()
+	recordEvent, events := mockRecorder()
+
+	m := new(v1beta1.Machine)
+	m.SetLabels(map[string]string{controller.MachinesetLabel: "some"})
+	m.Status.Addresses = []corev1.NodeAddress{
+		{Type: corev1.NodeExternalIP, Address: "203.0.113.10"},
+		{Type: corev1.NodeInternalIP, Address: "192.0.2.10"},
+	}
+	getMachine := func(string) (*v1beta1.Machine, error) { return m, nil }
+
+	// Machine addresses take precedence over the HostIP
+	res := controller.ReconcileSubnet(layout, hs, cm, getMachine, patchHostSubnet, recordEvent)
+	is.Equal(res.Outcome, controller.OutcomeUpdated)
+	is.Equal(patchedEgressCIDRs(t, *patches), []v1.HostSubnetEgressCIDR{"192.0.2.128/25"})
+	is.Equal(*events, []string{"some Normal EgressCIDRsUpdated", "some Warning EgressCIDRUnreachable"})
+
+	// HostIP is used without InternalIP
+	m.Status.Addresses = nil
+	res = controller.ReconcileSubnet(layout, hs, cm, getMachine, patchHostSubnet, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeUpdated)
+	is.Equal(patchedEgressCIDRs(t, *patches), []v1.HostSubnetEgressCIDR{"198.51.100.0/25"})
+
+	// CIDRs larger than the node subnet are never reachable
+	layout.NodeSubnetPrefix = 26
+	res = controller.ReconcileSubnet(layout, hs, cm, getMachine, patchHostSubnet, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeUpdated)
+	is.Equal(patchedEgressCIDRs(t, *patches), []v1.HostSubnetEgressCIDR{})
+}
+
+// patchedEgressCIDRs returns the egressCIDRs of the last patch.
+func patchedEgressCIDRs(t *testing.T, patches []string) []v1.HostSubnetEgressCIDR {
+	is := is.New(t)
+	is.True(len(patches) > 0)
+	patched := new(v1.HostSubnet)
+	is.NoErr(json.Unmarshal([]byte(patches[len(patches)-1]), patched))
+	return patched.EgressCIDRs
+}
+
+func TestReconcileNodePolicy(t *testing.T) {
+	is := is.New(t)
+	hs := mockHostSubnet("node123")
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.Set(controller.NodeKey("node123"), "192.0.2.0/24"))
+	counter := 0
+
+	getMachine := func(name string) (*v1beta1.Machine, error) {
+		counter++
+		return nil, errors.New("no machine")
+	}
+	patchHostSubnet, patchHostSubnetCalled := mockPatchHostSubnet(t, []v1.HostSubnetEgressCIDR{"192.0.2.0/24"})
+
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, cm, getMachine, patchHostSubnet, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeUpdated)
+	is.Equal(res.MachineSet, "")
+	is.Equal(counter, 0) // node entries don't need a Machine
+	is.Equal(*patchHostSubnetCalled, 1)
+}
+
+func TestReconcileAdopt(t *testing.T) {
+	is := is.New(t)
+	hs := mockHostSubnet("node123")
+	hs.EgressCIDRs = []v1.HostSubnetEgressCIDR{"198.51.100.0/24"}
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.Set("some", "192.0.2.0/24"))
+	cm.SetReleasePolicy("some", controller.ReleaseRestore)
+	getMachine, _ := mockGetMachine(t, "some", hs.Name)
+	patchHostSubnet, patches := capturePatches()
+
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, cm, getMachine, patchHostSubnet, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeUpdated)
+	is.Equal(len(*patches), 1)
+
+	patched := new(v1.HostSubnet)
+	is.NoErr(json.Unmarshal([]byte((*patches)[0]), patched))
+	is.Equal(patched.EgressCIDRs, []v1.HostSubnetEgressCIDR{"192.0.2.0/24"})
+	is.Equal(patched.Annotations[controller.AnnotationManagedBy], "some")
+	is.Equal(patched.Annotations[controller.AnnotationOnRelease], "restore")
+
+	snapshot := controller.Snapshot{}
+	is.NoErr(json.Unmarshal([]byte(patched.Annotations[controller.AnnotationOriginal]), &snapshot))
+	is.Equal(snapshot.EgressCIDRs, []v1.HostSubnetEgressCIDR{"198.51.100.0/24"})
+	is.True(!snapshot.TakenAt.IsZero())
+}
+
+func TestReconcileKeepSnapshot(t *testing.T) {
+	is := is.New(t)
+	hs := mockHostSubnet("node123")
+	markManaged(hs, "some", controller.ReleaseRestore)
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.Set("some", "192.0.2.0/24"))
+	cm.SetReleasePolicy("some", controller.ReleaseRestore)
+	getMachine, _ := mockGetMachine(t, "some", hs.Name)
+	patchHostSubnet, patches := capturePatches()
+
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, cm, getMachine, patchHostSubnet, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeUpdated)
+
+	patched := new(v1.HostSubnet)
+	is.NoErr(json.Unmarshal([]byte((*patches)[0]), patched))
+	_, ok := patched.Annotations[controller.AnnotationOriginal]
+	is.True(!ok) // already managed, no new snapshot
+}
+
+func TestReconcileReleaseRestore(t *testing.T) {
+	is := is.New(t)
+	hs := mockHostSubnet("node123")
+	hs.EgressCIDRs = []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}
+	markManaged(hs, "some", controller.ReleaseRestore)
+	hs.Annotations[controller.AnnotationOriginal] = `{"egressCIDRs":["198.51.100.0/24"],"takenAt":"2021-06-01T00:00:00Z"}`
+	getMachine, _ := mockGetMachine(t, "some", hs.Name)
+	patchHostSubnet, patches := capturePatches()
+
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, controller.NewCIDRMap(), getMachine, patchHostSubnet, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeReleased)
+	is.Equal(*patches, []string{
+		`{"egressCIDRs":["198.51.100.0/24"],"metadata":{"annotations":{"appuio.ch/egress-cidrs-managed-by":null,` +
+			`"appuio.ch/egress-cidrs-on-release":null,"appuio.ch/egress-cidrs-original":null}}}`,
+	})
+}
+
+func TestReconcileReleaseRestoreNoSnapshot(t *testing.T) {
+	is := is.New(t)
+	hs := mockHostSubnet("node123")
+	hs.EgressCIDRs = []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}
+	markManaged(hs, "some", controller.ReleaseRestore)
+	getMachine, _ := mockGetMachine(t, "some", hs.Name)
+	patchHostSubnet, patches := capturePatches()
+	recordEvent, events := mockRecorder()
+
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, controller.NewCIDRMap(), getMachine, patchHostSubnet, recordEvent)
+	is.Equal(res.Outcome, controller.OutcomeReleased)
+	is.Equal(*patches, []string{
+		`{"metadata":{"annotations":{"appuio.ch/egress-cidrs-managed-by":null,` +
+			`"appuio.ch/egress-cidrs-on-release":null,"appuio.ch/egress-cidrs-original":null}}}`,
+	})
+	is.Equal(*events, []string{
+		"some Warning EgressCIDRsRestoreFailed",
+		"some Normal EgressCIDRsReleased",
+	})
+}
+
+func TestReconcileReleaseKeep(t *testing.T) {
+	is := is.New(t)
+	hs := mockHostSubnet("node123")
+	hs.EgressCIDRs = []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}
+	markManaged(hs, "some", controller.ReleaseKeep)
+	getMachine, _ := mockGetMachine(t, "some", hs.Name)
+	patchHostSubnet, patches := capturePatches()
+	recordEvent, events := mockRecorder()
+
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, controller.NewCIDRMap(), getMachine, patchHostSubnet, recordEvent)
+	is.Equal(res.Outcome, controller.OutcomeReleased)
+	is.Equal(*patches, []string{
+		`{"metadata":{"annotations":{"appuio.ch/egress-cidrs-managed-by":null,` +
+			`"appuio.ch/egress-cidrs-on-release":null,"appuio.ch/egress-cidrs-original":null}}}`,
+	})
+	is.Equal(*events, []string{"some Normal EgressCIDRsReleased"})
+}
+
+func TestReconcileReleaseClear(t *testing.T) {
+	is := is.New(t)
+	hs := mockHostSubnet("node123")
+	hs.EgressCIDRs = []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}
+	markManaged(hs, "some", controller.ReleaseClear)
+	getMachine, _ := mockGetMachine(t, "some", hs.Name)
+	patchHostSubnet, patches := capturePatches()
+
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, controller.NewCIDRMap(), getMachine, patchHostSubnet, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeReleased)
+	is.Equal(*patches, []string{
+		`{"egressCIDRs":[],"metadata":{"annotations":{"appuio.ch/egress-cidrs-managed-by":null,` +
+			`"appuio.ch/egress-cidrs-on-release":null,"appuio.ch/egress-cidrs-original":null}}}`,
+	})
+}
+
+func TestReconcileUnmanagedNotReleased(t *testing.T) {
+	is := is.New(t)
+	hs := mockHostSubnet("node123")
+	hs.EgressCIDRs = []v1.HostSubnetEgressCIDR{"192.0.2.0/24"}
+	getMachine, _ := mockGetMachine(t, "some", hs.Name)
+
+	res := controller.ReconcileSubnet(controller.DefaultLayout(), hs, controller.NewCIDRMap(), getMachine, nil, discardEvents)
+	is.Equal(res.Outcome, controller.OutcomeSkipped)
+}
+
+func markManaged(hs *v1.HostSubnet, key string, policy controller.ReleasePolicy) {
+	hs.SetAnnotations(map[string]string{
+		controller.AnnotationManagedBy: key,
+		controller.AnnotationOnRelease: string(policy),
+	})
+}
+
+// capturePatches returns a HostSubnetPatcher which records all patches.
+func capturePatches() (controller.HostSubnetPatcher, *[]string) {
+	patches := new([]string)
+
+	fn := func(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*v1.HostSubnet, error) {
+		*patches = append(*patches, string(data))
+		return nil, nil
+	}
+
+	return fn, patches
 }
 
 func mockHostSubnet(name string) *v1.HostSubnet {
@@ -178,15 +477,34 @@ func mockGetMachine(t *testing.T, machineset, expectedName string) (controller.M
 	return fn, counter
 }
 
-func mockUpdateHostSubnet(t *testing.T, expectedHostsubnet []v1.HostSubnetEgressCIDR) (controller.HostSubnetUpdater, *int) {
+func mockPatchHostSubnet(t *testing.T, expectedHostsubnet []v1.HostSubnetEgressCIDR) (controller.HostSubnetPatcher, *int) {
 	is := is.New(t)
 	counter := new(int)
 
-	fn := func(ctx context.Context, hostSubnet *v1.HostSubnet, opts metav1.UpdateOptions) (*v1.HostSubnet, error) {
+	fn := func(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*v1.HostSubnet, error) {
 		(*counter)++
+		is.Equal(pt, types.MergePatchType)
+
+		hostSubnet := new(v1.HostSubnet)
+		is.NoErr(json.Unmarshal(data, hostSubnet))
 		is.Equal(hostSubnet.EgressCIDRs, expectedHostsubnet)
+		hostSubnet.SetName(name)
 		return hostSubnet, nil
 	}
 
 	return fn, counter
 }
+
+func discardEvents(*v1.HostSubnet, string, string, string, string, ...interface{}) {}
+
+// mockRecorder returns a Recorder which records events as
+// "<machineset> <type> <reason>".
+func mockRecorder() (controller.Recorder, *[]string) {
+	events := new([]string)
+
+	fn := func(hs *v1.HostSubnet, machineSet, eventtype, reason, messageFmt string, args ...interface{}) {
+		*events = append(*events, machineSet+" "+eventtype+" "+reason)
+	}
+
+	return fn, events
+}
@@ -0,0 +1,174 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "github.com/openshift/api/network/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// AnnotationManagedBy marks a HostSubnet or Node as managed. The value is
+	// the CIDRMap key it got its egress configuration from.
+	AnnotationManagedBy = "appuio.ch/egress-cidrs-managed-by"
+	// AnnotationOnRelease selects the ReleasePolicy. On a MachineSet it
+	// overrides the global default, on a HostSubnet it records the policy in
+	// effect when the HostSubnet was last updated.
+	AnnotationOnRelease = "appuio.ch/egress-cidrs-on-release"
+	// AnnotationOriginal holds a Snapshot of the egressCIDRs a HostSubnet had
+	// before the operator took it over.
+	AnnotationOriginal = "appuio.ch/egress-cidrs-original"
+)
+
+// ReleasePolicy defines what happens to the egressCIDRs of a managed HostSubnet
+// once it is no longer managed, e.g. because the annotation was removed from
+// its MachineSet or the MachineSet was deleted.
+type ReleasePolicy string
+
+const (
+	// ReleaseKeep leaves the egressCIDRs as they are.
+	ReleaseKeep ReleasePolicy = "keep"
+	// ReleaseClear removes all egressCIDRs.
+	ReleaseClear ReleasePolicy = "clear"
+	// ReleaseRestore restores the egressCIDRs from before the operator took
+	// the HostSubnet over.
+	ReleaseRestore ReleasePolicy = "restore"
+)
+
+// ParseReleasePolicy validates a ReleasePolicy.
+func ParseReleasePolicy(s string) (ReleasePolicy, error) {
+	switch p := ReleasePolicy(s); p {
+	case ReleaseKeep, ReleaseClear, ReleaseRestore:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid release policy %q, must be one of %s, %s, %s",
+		s, ReleaseKeep, ReleaseClear, ReleaseRestore)
+}
+
+// Snapshot is stored in AnnotationOriginal.
+type Snapshot struct {
+	EgressCIDRs []v1.HostSubnetEgressCIDR `json:"egressCIDRs,omitempty"`
+	// EgressAssignable is set on nodes and records whether the node had the
+	// LabelEgressAssignable.
+	EgressAssignable *bool       `json:"egressAssignable,omitempty"`
+	TakenAt          metav1.Time `json:"takenAt"`
+}
+
+// isManaged returns true if the marker annotations on `obj` match the CIDRMap
+// entry `key`.
+func isManaged(obj metav1.Object, cidrs *CIDRMap, key string) bool {
+	annotations := obj.GetAnnotations()
+	return annotations[AnnotationManagedBy] == key &&
+		ReleasePolicy(annotations[AnnotationOnRelease]) == cidrs.ReleasePolicy(key)
+}
+
+// managedAnnotations returns the marker annotations for `obj` managed through
+// the CIDRMap entry `key`. If the operator is taking `obj` over, a Snapshot of
+// its current egress configuration is included.
+func managedAnnotations(obj egressObject, cidrs *CIDRMap, key string) map[string]*string {
+	policy := string(cidrs.ReleasePolicy(key))
+	annotations := map[string]*string{
+		AnnotationManagedBy: &key,
+		AnnotationOnRelease: &policy,
+	}
+
+	if obj.GetAnnotations()[AnnotationManagedBy] == "" && obj.GetAnnotations()[AnnotationOriginal] == "" {
+		s := obj.snapshot()
+		s.TakenAt = metav1.Now()
+		snapshot, err := json.Marshal(s)
+		if err != nil {
+			klog.Errorf("%s<%s>: snapshot: %s", obj.kind(), obj.GetName(), err)
+		} else {
+			s := string(snapshot)
+			annotations[AnnotationOriginal] = &s
+		}
+	}
+
+	return annotations
+}
+
+// ReleaseSubnet removes the marker annotations from a no longer managed
+// HostSubnet and applies `policy` to its egressCIDRs.
+func ReleaseSubnet(
+	hs *v1.HostSubnet,
+	policy ReleasePolicy,
+	reason, machineset string,
+	patchHostSubnet HostSubnetPatcher,
+	recordEvent Recorder,
+) ReconcileResult {
+	return applyRelease(subnetObject{hs, patchHostSubnet, recordEvent}, policy, reason, machineset)
+}
+
+// releaseObject removes the marker annotations from a no longer managed `obj`
+// and applies the ReleasePolicy recorded on it.
+func releaseObject(obj egressObject, reason, machineset string) ReconcileResult {
+	policy := ReleasePolicy(obj.GetAnnotations()[AnnotationOnRelease])
+	return applyRelease(obj, policy, reason, machineset)
+}
+
+// applyRelease removes the marker annotations from a no longer managed `obj`
+// and applies `policy` to its egress configuration.
+func applyRelease(obj egressObject, policy ReleasePolicy, reason, machineset string) ReconcileResult {
+	kind, name := obj.kind(), obj.GetName()
+	klog.Infof("%s<%s>: %s, releasing (%s)", kind, name, reason, policy)
+
+	patch := objectPatch{
+		Annotations: map[string]*string{
+			AnnotationManagedBy: nil,
+			AnnotationOnRelease: nil,
+			AnnotationOriginal:  nil,
+		},
+	}
+	message := fmt.Sprintf("Released (%s), kept %s", reason, obj.state())
+
+	switch policy {
+	case ReleaseClear:
+		message = fmt.Sprintf("Released (%s), %s", reason, obj.clear(&patch))
+	case ReleaseRestore:
+		restored := ""
+		snapshot, err := snapshotOf(obj)
+		if err == nil {
+			restored, err = obj.restore(snapshot, &patch)
+		}
+		if err != nil {
+			klog.Errorf("%s<%s>: cannot restore, keeping %s: %s", kind, name, obj.state(), err)
+			obj.record(machineset, corev1.EventTypeWarning, ReasonRestoreFailed,
+				"Cannot restore, keeping %s: %s", obj.state(), err)
+			break
+		}
+		message = fmt.Sprintf("Released (%s), %s", reason, restored)
+	}
+
+	if err := obj.send(patch); err != nil {
+		klog.Errorf("%s<%s>: releasing: %s", kind, name, err)
+		obj.record(machineset, corev1.EventTypeWarning, ReasonUpdateFailed,
+			"Failed to release: %s", err)
+		return ReconcileResult{Outcome: OutcomeError, Reason: "release " + strings.ToLower(kind), MachineSet: machineset, Requeue: true, Err: err}
+	}
+
+	obj.record(machineset, corev1.EventTypeNormal, ReasonReleased, "%s", message)
+	return ReconcileResult{Outcome: OutcomeReleased, Reason: reason, MachineSet: machineset}
+}
+
+// snapshotOf returns the Snapshot stored on `obj`.
+func snapshotOf(obj metav1.Object) (Snapshot, error) {
+	var snapshot Snapshot
+	v, ok := obj.GetAnnotations()[AnnotationOriginal]
+	if !ok {
+		return snapshot, fmt.Errorf("no annotation %s", AnnotationOriginal)
+	}
+	if err := json.Unmarshal([]byte(v), &snapshot); err != nil {
+		return snapshot, fmt.Errorf("invalid annotation %s: %w", AnnotationOriginal, err)
+	}
+	return snapshot, nil
+}
+
+// formatTakenAt renders the time `s` was taken for events.
+func formatTakenAt(s Snapshot) string {
+	return s.TakenAt.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,220 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/openshift/api/network/v1"
+	configclient "github.com/openshift/client-go/config/clientset/versioned"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// NetworkConfigName is the name of the cluster wide
+	// network.config.openshift.io object.
+	NetworkConfigName = "cluster"
+	// InstallConfigNamespace and InstallConfigName locate the ConfigMap the
+	// installer stores the install-config in.
+	InstallConfigNamespace = "kube-system"
+	InstallConfigName      = "cluster-config-v1"
+	installConfigKey       = "install-config"
+
+	reservedRetryInterval = 10 * time.Second
+)
+
+// ReservedNetwork is a network of the cluster egress CIDRs must not collide
+// with.
+type ReservedNetwork struct {
+	// Name describes the network, e.g. "service network".
+	Name string
+	CIDR *net.IPNet
+	// AllowSubnets permits egress CIDRs within the network, as long as they
+	// don't cover all of it. Egress IPs have to be on the subnet of the
+	// node, so they are always part of a machine network.
+	AllowSubnets bool
+}
+
+func (n ReservedNetwork) String() string {
+	return fmt.Sprintf("%s %s", n.Name, n.CIDR)
+}
+
+// collides returns true if `cidr` can't be used as an egress CIDR.
+func (n ReservedNetwork) collides(cidr *net.IPNet) bool {
+	if n.AllowSubnets {
+		reserved, _ := n.CIDR.Mask.Size()
+		size, _ := cidr.Mask.Size()
+		return cidr.Contains(n.CIDR.IP) && size <= reserved
+	}
+	return cidr.Contains(n.CIDR.IP) || n.CIDR.Contains(cidr.IP)
+}
+
+// ReservedCIDRError is returned for a CIDR list that collides with reserved
+// networks.
+type ReservedCIDRError struct {
+	// Collisions maps CIDRs of the list to the networks they collide with.
+	Collisions map[string][]ReservedNetwork
+}
+
+func (e *ReservedCIDRError) Error() string {
+	cidrs := make([]string, 0, len(e.Collisions))
+	for cidr := range e.Collisions {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+
+	msgs := make([]string, len(cidrs))
+	for i, cidr := range cidrs {
+		networks := make([]string, len(e.Collisions[cidr]))
+		for j, n := range e.Collisions[cidr] {
+			networks[j] = n.String()
+		}
+		msgs[i] = fmt.Sprintf("%s collides with %s", cidr, strings.Join(networks, ", "))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// checkReserved returns a *ReservedCIDRError if any of the parsed `cidrs`
+// collides with one of the `reserved` networks.
+func checkReserved(reserved []ReservedNetwork, cidrs []v1.HostSubnetEgressCIDR) error {
+	collisions := make(map[string][]ReservedNetwork)
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(string(cidr))
+		if err != nil {
+			// "none"
+			continue
+		}
+		for _, n := range reserved {
+			if n.collides(ipnet) {
+				collisions[string(cidr)] = append(collisions[string(cidr)], n)
+			}
+		}
+	}
+	if len(collisions) > 0 {
+		return &ReservedCIDRError{Collisions: collisions}
+	}
+	return nil
+}
+
+// ParseReservedNetworks parses `cidrs` as networks named `name`. Invalid and
+// IPv6 entries are skipped, as egress CIDRs are IPv4 only.
+func ParseReservedNetworks(name string, allowSubnets bool, cidrs ...string) []ReservedNetwork {
+	networks := make([]ReservedNetwork, 0, len(cidrs))
+	for _, s := range cidrs {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			klog.Warningf("ReservedNetworks: ignoring invalid %s %q: %s", name, s, err)
+			continue
+		}
+		if ipnet.IP.To4() == nil {
+			continue
+		}
+		networks = append(networks, ReservedNetwork{Name: name, CIDR: ipnet, AllowSubnets: allowSubnets})
+	}
+	return networks
+}
+
+// LoadReservedNetworks reads the cluster and service networks from the
+// network.config.openshift.io object and the machine networks from the
+// install-config. A missing object is logged and skipped.
+func LoadReservedNetworks(ctx context.Context, config *rest.Config) ([]ReservedNetwork, error) {
+	networks := make([]ReservedNetwork, 0)
+
+	client, err := configclient.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := client.ConfigV1().Networks().Get(ctx, NetworkConfigName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		klog.Warningf("ReservedNetworks: network.config.openshift.io/%s not found, not checking cluster and service networks", NetworkConfigName)
+	case err != nil:
+		return nil, fmt.Errorf("get network config: %w", err)
+	default:
+		// The status holds the deployed configuration, the spec is only
+		// used until the network operator reported it.
+		clusterNetwork, serviceNetwork := nc.Status.ClusterNetwork, nc.Status.ServiceNetwork
+		if len(clusterNetwork) == 0 {
+			clusterNetwork = nc.Spec.ClusterNetwork
+		}
+		if len(serviceNetwork) == 0 {
+			serviceNetwork = nc.Spec.ServiceNetwork
+		}
+		for _, e := range clusterNetwork {
+			networks = append(networks, ParseReservedNetworks("cluster network", false, e.CIDR)...)
+		}
+		networks = append(networks, ParseReservedNetworks("service network", false, serviceNetwork...)...)
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	cm, err := kubeClient.CoreV1().ConfigMaps(InstallConfigNamespace).Get(ctx, InstallConfigName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		klog.Warningf("ReservedNetworks: configmap %s/%s not found, not checking machine networks", InstallConfigNamespace, InstallConfigName)
+	case err != nil:
+		return nil, fmt.Errorf("get install-config: %w", err)
+	default:
+		machineNetworks, err := parseMachineNetworks([]byte(cm.Data[installConfigKey]))
+		if err != nil {
+			return nil, fmt.Errorf("configmap %s/%s: %w", InstallConfigNamespace, InstallConfigName, err)
+		}
+		networks = append(networks, ParseReservedNetworks("machine network", true, machineNetworks...)...)
+	}
+
+	return networks, nil
+}
+
+// loadReserved loads the reserved networks into the CIDRMap, retrying until
+// it succeeds or `ctx` is done. Returns false if `ctx` is done.
+func (c *Controller) loadReserved(ctx context.Context) bool {
+	err := wait.PollImmediateUntil(reservedRetryInterval, func() (bool, error) {
+		networks, err := LoadReservedNetworks(ctx, c.config)
+		if err != nil {
+			klog.Errorf("ReservedNetworks: %s", err)
+			return false, nil
+		}
+		klog.Infof("ReservedNetworks: %v", networks)
+		c.cidrs.SetReserved(networks)
+		return true, nil
+	}, ctx.Done())
+	return err == nil
+}
+
+// installConfig is the part of the install-config holding the machine
+// networks. Clusters installed before OpenShift 4.3 only have machineCIDR.
+type installConfig struct {
+	Networking struct {
+		MachineNetwork []struct {
+			CIDR string `json:"cidr"`
+		} `json:"machineNetwork"`
+		MachineCIDR string `json:"machineCIDR"`
+	} `json:"networking"`
+}
+
+func parseMachineNetworks(data []byte) ([]string, error) {
+	var ic installConfig
+	if err := yaml.Unmarshal(data, &ic); err != nil {
+		return nil, err
+	}
+
+	cidrs := make([]string, 0, len(ic.Networking.MachineNetwork)+1)
+	for _, n := range ic.Networking.MachineNetwork {
+		cidrs = append(cidrs, n.CIDR)
+	}
+	if len(cidrs) == 0 && ic.Networking.MachineCIDR != "" {
+		cidrs = append(cidrs, ic.Networking.MachineCIDR)
+	}
+	return cidrs, nil
+}
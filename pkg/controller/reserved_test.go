@@ -0,0 +1,65 @@
+package controller_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	"github.com/matryer/is"
+	v1 "github.com/openshift/api/network/v1"
+)
+
+func TestCIDRMapReserved(t *testing.T) {
+	is := is.New(t)
+	reserved := append(controller.ParseReservedNetworks("cluster network", false, "10.128.0.0/14", "fd01::/48"),
+		controller.ParseReservedNetworks("service network", false, "172.30.0.0/16")...)
+	reserved = append(reserved, controller.ParseReservedNetworks("machine network", true, "192.0.2.0/24")...)
+	is.Equal(len(reserved), 3) // IPv6 is skipped
+
+	cm := controller.NewCIDRMap()
+	cm.SetReserved(reserved)
+
+	for _, c := range []struct {
+		Name, Input string
+		Collides    []string
+	}{
+		{"unrelated", "203.0.113.0/24", nil},
+		{"none", "none", nil},
+		{"machine-subnet", "192.0.2.32/27", nil},
+		{"machine-network", "192.0.2.0/24", []string{"192.0.2.0/24"}},
+		{"containing-machine-network", "192.0.0.0/16", []string{"192.0.0.0/16"}},
+		{"in-cluster-network", "10.128.4.0/24", []string{"10.128.4.0/24"}},
+		{"containing-service-network", "172.16.0.0/12", []string{"172.16.0.0/12"}},
+		{"partial", "203.0.113.0/24,172.30.1.0/24", []string{"172.30.1.0/24"}},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			is := is.New(t)
+			err := cm.Set(c.Name, c.Input)
+			is.Equal(err, cm.Validate(c.Input))
+			if c.Collides == nil {
+				is.NoErr(err)
+				return
+			}
+
+			var reservedErr *controller.ReservedCIDRError
+			is.True(errors.As(err, &reservedErr))
+			is.Equal(len(reservedErr.Collisions), len(c.Collides))
+			for _, cidr := range c.Collides {
+				is.Equal(len(reservedErr.Collisions[cidr]), 1)
+			}
+			is.True(!cm.Exists(c.Name))
+		})
+	}
+}
+
+func TestCIDRMapReservedKeepsValue(t *testing.T) {
+	is := is.New(t)
+	cm := controller.NewCIDRMap()
+	is.NoErr(cm.Set("foo", "203.0.113.0/24"))
+	cm.SetReserved(controller.ParseReservedNetworks("service network", false, "172.30.0.0/16"))
+
+	err := cm.Set("foo", "172.30.0.0/24")
+	is.Equal(err.Error(), "172.30.0.0/24 collides with service network 172.30.0.0/16")
+	is.Equal(cm.Get("foo"), []v1.HostSubnetEgressCIDR{"203.0.113.0/24"})
+	is.Equal(cm.Overlapping("bar", "172.30.0.0/24"), []controller.Overlap(nil))
+}
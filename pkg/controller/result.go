@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"fmt"
+)
+
+// Outcome classifies the result of a reconciliation.
+type Outcome string
+
+const (
+	// OutcomeUpdated means the HostSubnet's egressCIDRs were changed.
+	OutcomeUpdated Outcome = "updated"
+	// OutcomeUpToDate means the HostSubnet already had the desired value.
+	OutcomeUpToDate Outcome = "up_to_date"
+	// OutcomeReleased means the HostSubnet is no longer managed and its
+	// ReleasePolicy was applied.
+	OutcomeReleased Outcome = "released"
+	// OutcomeSkipped means the HostSubnet is not managed, e.g. because its
+	// MachineSet has no CIDRs configured.
+	OutcomeSkipped Outcome = "skipped"
+	// OutcomeIgnored means the HostSubnet is never managed, e.g. masters.
+	OutcomeIgnored Outcome = "ignored"
+	// OutcomeError means the reconciliation failed, see Err.
+	OutcomeError Outcome = "error"
+)
+
+// ReconcileResult is returned by ReconcileSubnet.
+type ReconcileResult struct {
+	Outcome Outcome
+	// Reason is a short explanation of the outcome.
+	Reason string
+	// MachineSet the HostSubnet belongs to, empty if unknown.
+	MachineSet string
+	// Requeue is true if trying again later might yield a different outcome.
+	Requeue bool
+	// Err is the underlying error for OutcomeError.
+	Err error
+}
+
+func (r ReconcileResult) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%s: %s: %s", r.Outcome, r.Reason, r.Err)
+	}
+	return fmt.Sprintf("%s: %s", r.Outcome, r.Reason)
+}
@@ -0,0 +1,216 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	v1 "github.com/openshift/api/network/v1"
+	configclient "github.com/openshift/client-go/config/clientset/versioned"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// NetworkType is the network plugin of the cluster, as reported by
+// network.config.openshift.io.
+type NetworkType string
+
+const (
+	// NetworkTypeOpenShiftSDN assigns egress IPs through the egressCIDRs of
+	// HostSubnets.
+	NetworkTypeOpenShiftSDN NetworkType = "OpenShiftSDN"
+	// NetworkTypeOVNKubernetes assigns egress IPs to nodes with the
+	// LabelEgressAssignable.
+	NetworkTypeOVNKubernetes NetworkType = "OVNKubernetes"
+)
+
+// DetectNetworkType returns the network type of the cluster. Unless
+// `configured` is set, it's read from the network.config.openshift.io object,
+// or derived from the served APIs if there is none. Either way, the type must
+// be supported and its API served by the cluster.
+func DetectNetworkType(ctx context.Context, client configclient.Interface, configured NetworkType) (NetworkType, error) {
+	networkType, source := configured, "configuration"
+	if networkType == "" {
+		reported, err := reportedNetworkType(ctx, client)
+		switch {
+		case apierrors.IsNotFound(err):
+			klog.Infof("Network config %s not found, detecting network type from the served APIs", NetworkConfigName)
+		case err != nil:
+			return "", fmt.Errorf("get network config: %w", err)
+		}
+		networkType, source = reported, "network config "+NetworkConfigName
+	}
+
+	served := make(map[NetworkType]bool, len(networkTypeResources))
+	for t, r := range networkTypeResources {
+		ok, err := servesResource(client.Discovery(), r.GroupVersion().String(), r.Resource)
+		if err != nil {
+			return "", fmt.Errorf("discover %s: %w", r, err)
+		}
+		served[t] = ok
+	}
+
+	if networkType == "" {
+		switch {
+		case served[NetworkTypeOpenShiftSDN] && served[NetworkTypeOVNKubernetes]:
+			return "", fmt.Errorf("both %s and %s APIs are served, set the network type explicitly",
+				NetworkTypeOpenShiftSDN, NetworkTypeOVNKubernetes)
+		case served[NetworkTypeOpenShiftSDN]:
+			networkType = NetworkTypeOpenShiftSDN
+		case served[NetworkTypeOVNKubernetes]:
+			networkType = NetworkTypeOVNKubernetes
+		default:
+			return "", fmt.Errorf("could not detect network type: neither %s nor %s are served",
+				networkTypeResources[NetworkTypeOpenShiftSDN], networkTypeResources[NetworkTypeOVNKubernetes])
+		}
+		source = "API discovery"
+	}
+
+	r, supported := networkTypeResources[networkType]
+	if !supported {
+		return "", fmt.Errorf("unsupported network type %q from %s, must be %s or %s",
+			networkType, source, NetworkTypeOpenShiftSDN, NetworkTypeOVNKubernetes)
+	}
+	if !served[networkType] {
+		return "", fmt.Errorf("network type %s from %s, but %s is not served by the cluster", networkType, source, r)
+	}
+	klog.Infof("Network type %s from %s", networkType, source)
+	return networkType, nil
+}
+
+// networkTypeResources are the resources which must be served for each
+// supported network type.
+var networkTypeResources = map[NetworkType]schema.GroupVersionResource{
+	NetworkTypeOpenShiftSDN:  v1.GroupVersion.WithResource("hostsubnets"),
+	NetworkTypeOVNKubernetes: {Group: "k8s.ovn.org", Version: "v1", Resource: "egressips"},
+}
+
+// reportedNetworkType returns the network type from the
+// network.config.openshift.io object.
+func reportedNetworkType(ctx context.Context, client configclient.Interface) (NetworkType, error) {
+	nc, err := client.ConfigV1().Networks().Get(ctx, NetworkConfigName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	// The spec is only used until the network operator reported the status
+	networkType := nc.Status.NetworkType
+	if networkType == "" {
+		networkType = nc.Spec.NetworkType
+	}
+	return NetworkType(networkType), nil
+}
+
+// servesResource returns true if `resource` in `groupVersion` is served.
+func servesResource(client discovery.DiscoveryInterface, groupVersion, resource string) (bool, error) {
+	resources, err := client.ServerResourcesForGroupVersion(groupVersion)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// egressTarget applies the CIDRMap to the objects a network plugin reads its
+// egress IP configuration from. All objects are identified by node name.
+type egressTarget interface {
+	// start starts the informers of the target and waits for their initial
+	// sync. Returns false if `ctx` is done first.
+	start(ctx context.Context) bool
+	// nodes returns the names of all nodes known to the target.
+	nodes() ([]string, error)
+	// reconcile applies the CIDRMap to node `name`. Writes use `ctx`.
+	reconcile(ctx context.Context, current settings, name string) ReconcileResult
+	// inSync returns true if node `name` has the `desired` CIDRs applied the
+	// way reconcile applies them with `layout`, e.g. without unreachable
+	// CIDRs.
+	inSync(layout Layout, name string, desired []v1.HostSubnetEgressCIDR) bool
+}
+
+// newTarget returns the egressTarget for `networkType`.
+func (c *Controller) newTarget(networkType NetworkType) (egressTarget, error) {
+	switch networkType {
+	case NetworkTypeOpenShiftSDN:
+		return c.newSDNTarget(), nil
+	case NetworkTypeOVNKubernetes:
+		return c.newOVNTarget(), nil
+	}
+	return nil, fmt.Errorf("unsupported network type %q, must be %s or %s",
+		networkType, NetworkTypeOpenShiftSDN, NetworkTypeOVNKubernetes)
+}
+
+// sdnTarget manages the egressCIDRs of HostSubnets.
+type sdnTarget struct {
+	c *Controller
+}
+
+func (c *Controller) newSDNTarget() sdnTarget {
+	c.createNetworkInformer()
+	c.health.watchInformer("hostsubnets", c.hostSubNetInformer.Informer())
+	c.health.watchInformer("netnamespaces", c.netNamespaceInformer.Informer())
+	return sdnTarget{c}
+}
+
+func (t sdnTarget) start(ctx context.Context) bool {
+	t.c.networkInformerFactory.Start(ctx.Done())
+	return cache.WaitForCacheSync(ctx.Done(),
+		t.c.hostSubNetInformer.Informer().HasSynced,
+		t.c.netNamespaceInformer.Informer().HasSynced,
+	)
+}
+
+func (t sdnTarget) nodes() ([]string, error) {
+	hostSubnets, err := t.c.hostSubnets.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(hostSubnets))
+	for i, hs := range hostSubnets {
+		names[i] = hs.Name
+	}
+	return names, nil
+}
+
+func (t sdnTarget) reconcile(ctx context.Context, current settings, name string) ReconcileResult {
+	hs, err := t.c.hostSubnets.Get(name)
+	if apierrors.IsNotFound(err) {
+		klog.V(8).Infof("HostSubnet<%s>: gone, skipping", name)
+		return ReconcileResult{Outcome: OutcomeSkipped, Reason: "hostsubnet gone"}
+	}
+	if err != nil {
+		return ReconcileResult{Outcome: OutcomeError, Reason: "get hostsubnet", Requeue: true, Err: err}
+	}
+
+	// Assignments are only recomputed once they are stale. Nodes moving
+	// between MachineSets change both assignments.
+	ms := t.c.machineSetForNode(name)
+	if managedBy := hs.Annotations[AnnotationEgressIPsManagedBy]; managedBy != "" && managedBy != ms {
+		t.c.invalidateAssignment(managedBy)
+		t.c.assignEgressIPs(managedBy)
+	}
+	if ms != "" {
+		t.c.assignEgressIPs(ms)
+	}
+	return ReconcileSubnet(current.layout, hs, t.c.cidrs, t.c.index.MachineForNode, t.c.patcher(ctx, current.dryRun), t.c.recordEvent)
+}
+
+func (t sdnTarget) inSync(layout Layout, name string, desired []v1.HostSubnetEgressCIDR) bool {
+	hs, err := t.c.hostSubnets.Get(name)
+	if err != nil {
+		return false
+	}
+	// Without a Machine, reachability is checked against the hostIP
+	machine, _ := t.c.index.MachineForNode(name)
+	applied, _ := subnetEgressCIDRs(layout, hs, machine, desired)
+	return equalCIDRs(applied, hs.EgressCIDRs)
+}
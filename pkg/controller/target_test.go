@@ -0,0 +1,70 @@
+package controller_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	"github.com/matryer/is"
+	configv1 "github.com/openshift/api/config/v1"
+	"github.com/openshift/client-go/config/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestDetectNetworkType(t *testing.T) {
+	for _, c := range []struct {
+		Name       string
+		Configured controller.NetworkType
+		Status     string
+		Spec       string
+		Served     []string
+		Expected   controller.NetworkType
+		Err        bool
+	}{
+		{"status", "", "OVNKubernetes", "OpenShiftSDN", []string{"egressips"}, controller.NetworkTypeOVNKubernetes, false},
+		{"spec", "", "", "OpenShiftSDN", []string{"hostsubnets"}, controller.NetworkTypeOpenShiftSDN, false},
+		{"discovery-sdn", "", "", "", []string{"hostsubnets"}, controller.NetworkTypeOpenShiftSDN, false},
+		{"discovery-ovn", "", "", "", []string{"egressips"}, controller.NetworkTypeOVNKubernetes, false},
+		{"discovery-ambiguous", "", "", "", []string{"hostsubnets", "egressips"}, "", true},
+		{"discovery-none", "", "", "", nil, "", true},
+		{"unsupported", "", "Calico", "", []string{"hostsubnets"}, "", true},
+		{"not-served", "", "OpenShiftSDN", "", []string{"egressips"}, "", true},
+		{"configured", controller.NetworkTypeOVNKubernetes, "OpenShiftSDN", "", []string{"hostsubnets", "egressips"}, controller.NetworkTypeOVNKubernetes, false},
+		{"configured-not-served", controller.NetworkTypeOVNKubernetes, "", "", []string{"hostsubnets"}, "", true},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			is := is.New(t)
+			objects := []runtime.Object{}
+			if c.Status != "" || c.Spec != "" {
+				objects = append(objects, &configv1.Network{
+					ObjectMeta: metav1.ObjectMeta{Name: controller.NetworkConfigName},
+					Spec:       configv1.NetworkSpec{NetworkType: c.Spec},
+					Status:     configv1.NetworkStatus{NetworkType: c.Status},
+				})
+			}
+			client := fake.NewSimpleClientset(objects...)
+			client.Resources = mockAPIResources(c.Served...)
+
+			networkType, err := controller.DetectNetworkType(context.Background(), client, c.Configured)
+			is.Equal(err != nil, c.Err)
+			is.Equal(networkType, c.Expected)
+		})
+	}
+}
+
+// mockAPIResources returns the discovery information for a cluster serving
+// the `resources` out of hostsubnets and egressips.
+func mockAPIResources(resources ...string) []*metav1.APIResourceList {
+	sdn := &metav1.APIResourceList{GroupVersion: "network.openshift.io/v1"}
+	ovn := &metav1.APIResourceList{GroupVersion: "k8s.ovn.org/v1"}
+	for _, r := range resources {
+		switch r {
+		case "hostsubnets":
+			sdn.APIResources = append(sdn.APIResources, metav1.APIResource{Name: r, Kind: "HostSubnet"})
+		case "egressips":
+			ovn.APIResources = append(ovn.APIResources, metav1.APIResource{Name: r, Kind: "EgressIP"})
+		}
+	}
+	return []*metav1.APIResourceList{sdn, ovn}
+}
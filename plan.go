@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/apis/egress/v1alpha1"
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	networkv1 "github.com/openshift/api/network/v1"
+	network "github.com/openshift/client-go/network/clientset/versioned"
+	"github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	machine "github.com/openshift/machine-api-operator/pkg/generated/clientset/versioned"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// Exit codes of the `plan` subcommand
+const (
+	planExitError   = 1
+	planExitPending = 2
+)
+
+// runPlan implements the `plan` subcommand. It computes the desired
+// egressCIDRs of all HostSubnets once and prints the difference to the
+// actual values.
+func runPlan(args []string, opts controller.Options) {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	output := fs.String("o", "table", "Output format: table or json")
+	all := fs.Bool("all", false, "Also list HostSubnets without pending changes")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s plan [-o table|json] [-all]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Exits with %d if changes are pending and %d on errors.\n", planExitPending, planExitError)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *output != "table" && *output != "json" {
+		fs.Usage()
+		os.Exit(planExitError)
+	}
+
+	plan, err := loadPlan(context.Background(), newConfig(), opts)
+	if err != nil {
+		klog.Error(err)
+		os.Exit(planExitError)
+	}
+
+	pending, failed := false, false
+	shown := make([]controller.PlanEntry, 0, len(plan))
+	for _, e := range plan {
+		pending = pending || e.Pending
+		failed = failed || e.Outcome == controller.OutcomeError
+		if *all || e.Pending || e.Outcome == controller.OutcomeError {
+			shown = append(shown, e)
+		}
+	}
+
+	if *output == "json" {
+		err = printPlanJSON(os.Stdout, shown)
+	} else {
+		err = printPlanTable(os.Stdout, shown)
+	}
+	if err != nil {
+		klog.Error(err)
+		os.Exit(planExitError)
+	}
+
+	switch {
+	case failed:
+		os.Exit(planExitError)
+	case pending:
+		os.Exit(planExitPending)
+	}
+}
+
+// loadPlan lists all relevant objects once and computes the plan.
+func loadPlan(ctx context.Context, config *rest.Config, opts controller.Options) ([]controller.PlanEntry, error) {
+	layout := opts.Layout
+	kubeClient := clientset.NewForConfigOrDie(config)
+	machineClient := machine.NewForConfigOrDie(config).MachineV1beta1()
+
+	machineSets, err := machineClient.MachineSets(layout.MachineNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list machinesets: %w", err)
+	}
+	machines, err := machineClient.Machines(layout.MachineNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list machines: %w", err)
+	}
+	nodes, err := kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list nodes: %w", err)
+	}
+	networkClient := network.NewForConfigOrDie(config).NetworkV1()
+	hostSubnets, err := networkClient.HostSubnets().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list hostsubnets: %w", err)
+	}
+	netNamespaces, err := networkClient.NetNamespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list netnamespaces: %w", err)
+	}
+	policies, err := listPolicies(ctx, config, kubeClient)
+	if err != nil {
+		return nil, fmt.Errorf("list egresscidrpolicies: %w", err)
+	}
+	reserved, err := controller.LoadReservedNetworks(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("load reserved networks: %w", err)
+	}
+
+	machineIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, controller.MachineIndexers)
+	msList := make([]*v1beta1.MachineSet, 0, len(machineSets.Items))
+	for i := range machineSets.Items {
+		msList = append(msList, &machineSets.Items[i])
+	}
+	for i := range machines.Items {
+		if err := machineIndexer.Add(&machines.Items[i]); err != nil {
+			return nil, err
+		}
+	}
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, controller.NodeIndexers)
+	nodeList := make([]*corev1.Node, 0, len(nodes.Items))
+	for i := range nodes.Items {
+		nodeList = append(nodeList, &nodes.Items[i])
+		if err := nodeIndexer.Add(&nodes.Items[i]); err != nil {
+			return nil, err
+		}
+	}
+	hsList := make([]*networkv1.HostSubnet, 0, len(hostSubnets.Items))
+	for i := range hostSubnets.Items {
+		hsList = append(hsList, &hostSubnets.Items[i])
+	}
+
+	netnsList := make([]*networkv1.NetNamespace, 0, len(netNamespaces.Items))
+	for i := range netNamespaces.Items {
+		netnsList = append(netnsList, &netNamespaces.Items[i])
+	}
+
+	cidrs, errs := controller.BuildCIDRMap(opts, reserved, msList, policies, nodeList)
+	for _, err := range errs {
+		klog.Warningf("ignoring %s", err)
+	}
+	for _, err := range controller.GuardCIDRMap(opts, cidrs, hsList, netnsList, msList, policies, nodeList) {
+		klog.Warning(err)
+	}
+
+	index := controller.NewMachineNodeIndex(machineIndexer, nodeIndexer)
+	return controller.Plan(layout, hsList, cidrs, index.MachineForNode), nil
+}
+
+// listPolicies returns all EgressCIDRPolicies, or none if the API is not
+// available.
+func listPolicies(ctx context.Context, config *rest.Config, kubeClient clientset.Interface) ([]*v1alpha1.EgressCIDRPolicy, error) {
+	gv := v1alpha1.SchemeGroupVersion.String()
+	if _, err := kubeClient.Discovery().ServerResourcesForGroupVersion(gv); err != nil {
+		klog.V(2).Infof("EgressCIDRPolicy API %s not available: %s", gv, err)
+		return nil, nil
+	}
+
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	list, err := client.Resource(v1alpha1.EgressCIDRPolicies).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make([]*v1alpha1.EgressCIDRPolicy, 0, len(list.Items))
+	for _, u := range list.Items {
+		p := new(v1alpha1.EgressCIDRPolicy)
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), p); err != nil {
+			klog.Warningf("EgressCIDRPolicy<%s>: decode: %s", u.GetName(), err)
+			continue
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+func printPlanTable(w io.Writer, plan []controller.PlanEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tMACHINESET\tOUTCOME\tACTUAL\tDESIRED\tREASON")
+	for _, e := range plan {
+		reason := e.Reason
+		if e.Error != "" {
+			reason += ": " + e.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Node, orNone(e.MachineSet), e.Outcome, formatCIDRs(e.Actual), formatCIDRs(e.Desired), reason)
+	}
+	return tw.Flush()
+}
+
+func printPlanJSON(w io.Writer, plan []controller.PlanEntry) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plan)
+}
+
+func formatCIDRs(cidrs []networkv1.HostSubnetEgressCIDR) string {
+	s := make([]string, len(cidrs))
+	for i, c := range cidrs {
+		s[i] = string(c)
+	}
+	return orNone(strings.Join(s, ","))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
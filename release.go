@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/appuio/openshift-machineset-egress-cidr-operator/pkg/controller"
+	v1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/client-go/network/clientset/versioned"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// runRelease implements the `release` subcommand. It releases the HostSubnets
+// of the given nodes immediately, without waiting for the controller.
+func runRelease(args []string) {
+	fs := flag.NewFlagSet("release", flag.ExitOnError)
+	policy := fs.String("policy", string(controller.ReleaseRestore),
+		"What to do with the egressCIDRs: keep, clear or restore")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s release [-policy=restore] NODE...\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Remove the egress CIDR annotation from the MachineSet first, or the controller will take the HostSubnet over again.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	p, err := controller.ParseReleasePolicy(*policy)
+	if err != nil {
+		klog.Exit(err)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client := versioned.NewForConfigOrDie(newConfig()).NetworkV1().HostSubnets()
+	failed := false
+	for _, node := range fs.Args() {
+		hs, err := client.Get(context.Background(), node, metav1.GetOptions{})
+		if err != nil {
+			klog.Errorf("HostSubnet<%s>: %s", node, err)
+			failed = true
+			continue
+		}
+		if hs.Annotations[controller.AnnotationManagedBy] == "" {
+			klog.Warningf("HostSubnet<%s>: not managed", node)
+		}
+
+		res := controller.ReleaseSubnet(hs, p, "released by command", "", client.Patch, logEvent)
+		if res.Err != nil {
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// logEvent is a controller.Recorder which only logs.
+func logEvent(hs *v1.HostSubnet, _, eventtype, reason, messageFmt string, args ...interface{}) {
+	klog.Infof("HostSubnet<%s>: %s %s: %s", hs.Name, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}